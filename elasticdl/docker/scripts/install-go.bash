@@ -4,17 +4,21 @@ set -e
 
 GO_MIRROR_URL=$1
 
-curl --silent "$GO_MIRROR_URL"/go1.13.4.linux-amd64.tar.gz | \
+# Go 1.22 or later is required by the OpenTelemetry SDK used by the PS.
+GO_VERSION=1.23.4
+
+curl --silent "$GO_MIRROR_URL"/go"$GO_VERSION".linux-amd64.tar.gz | \
     tar -C /usr/local -xzf -
 
 go env -w GO111MODULE=on
 go env -w GOPROXY=https://goproxy.io,direct
 
-go get github.com/golang/protobuf/protoc-gen-go@v1.3.2 > /dev/null
-go get golang.org/x/lint/golint > /dev/null
-go get golang.org/x/tools/cmd/goyacc > /dev/null
-go get golang.org/x/tools/cmd/cover > /dev/null
-go get github.com/mattn/goveralls > /dev/null
-go get github.com/rakyll/gotest > /dev/null
+# The tools are pinned to releases which build with GO_VERSION, the latest
+# releases may require a newer Go.
+go install github.com/golang/protobuf/protoc-gen-go@v1.3.2 > /dev/null
+go install golang.org/x/lint/golint@v0.0.0-20241112194109-818c5a804067 > /dev/null
+go install golang.org/x/tools/cmd/goyacc@v0.28.0 > /dev/null
+go install github.com/mattn/goveralls@v0.0.12 > /dev/null
+go install github.com/rakyll/gotest@v0.0.6 > /dev/null
 
 cp "$GOPATH"/bin/* /usr/local/bin/
@@ -14,61 +14,196 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"elasticdl.org/elasticdl/pkg/common"
+	"elasticdl.org/elasticdl/pkg/logging"
+	"elasticdl.org/elasticdl/pkg/proto"
 	"elasticdl.org/elasticdl/pkg/ps"
+	"elasticdl.org/elasticdl/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// defaults are the defaults of the flags which configure the server
+var defaults = ps.DefaultServerConfig()
+
 var (
 	jobName               = flag.String("job_name", "", "ElasticDL job name")
 	namespace             = flag.String("namespace", "", "The name of the Kubernetes namespace where ElasticDL pods will be created")
 	masterAddr            = flag.String("master_addr", "localhost:50001", "The master pod address")
+	masterDialTimeout     = flag.Duration("master_dial_timeout", defaults.MasterDialTimeout, "The timeout to connect to the master. If 0, connect in the background and retry until the master is reachable")
+	masterReportTimeout   = flag.Duration("master_report_timeout", defaults.MasterReportTimeout, "The timeout of each model version report to the master, failed reports are retried with backoff")
+	heartbeatInterval     = flag.Duration("heartbeat_interval", defaults.HeartbeatInterval, "Register to the master and send a heartbeat every this long, the master sets it if it watches heartbeats. If 0, heartbeats are disabled")
 	port                  = flag.Int("port", 2222, "The server port")
+	address               = flag.String("address", "", "The address to serve at, such as localhost:0. If empty, serve at MY_POD_IP and port")
+	standalone            = flag.Bool("standalone", false, "Run without Kubernetes for local development: do not wait for the master, which may be absent, or watch it to shut down. The master is only reported to if master_addr is given")
+	httpPort              = flag.Int("http_port", 0, "The port of the HTTP server for /metrics, /healthz and /readyz. If 0, the HTTP server is disabled")
 	useAsync              = flag.Bool("use_async", false, "true for asynchronous SGD, false for synchronous SGD")
 	gradsToWait           = flag.Int("grads_to_wait", 1, "Number of gradients to wait before updating mode")
 	lrStalenessModulation = flag.Bool("lr_staleness_modulation", false, "If True, PS will modulate the learning rate with staleness")
 	syncVersionTolerance  = flag.Int("sync_version_tolerance", 0, "The maximum model version difference between reported gradients and PS that synchronous SGD can accepts")
 	evaluationSteps       = flag.Int("evaluation_steps", 0, "Evaluate the model every this many steps. If 0, evaluation is disabled")
-	numPsPods             = flag.Int("num_ps_pods", 1, "Number of PS pod")
+	numPsPods             = flag.Int("num_ps_pods", defaults.NumPsPods, "Number of PS pod")
 	psID                  = flag.Int("ps_id", 0, "PS id")
 	numWorkers            = flag.Int("num_workers", 1, "Number of workers")
 	checkpointDirForInit  = flag.String("checkpoint_dir_for_init", "", "The checkpoint directory to initialize the training model")
 	checkpointDir         = flag.String("checkpoint_dir", "", "The directory to store the checkpoint file")
 	checkpointSteps       = flag.Int("checkpoint_steps", 0, "Save checkpoint every this many steps. If 0, no checkpoints to save")
-	keepCheckpointMax     = flag.Int("keep_checkpoint_max", 3, "The maximum number of recent checkpoint files to keep. If 0, keep all")
+	keepCheckpointMax     = flag.Int("keep_checkpoint_max", defaults.KeepCheckpointMax, "The maximum number of recent checkpoint files to keep. If 0, keep all")
 	optType               = flag.String("opt_type", "unknown", "optimizer type")
 	optArgs               = flag.String("opt_args", "", "optimizer arguments")
+	numGradThreads        = flag.Int("num_grad_threads", 0, "Number of goroutines to apply gradients in parallel. If 0, use the number of CPUs")
+	hogwild               = flag.Bool("hogwild", false, "If true, apply gradients without waiting for each other and serve pulls without parameter locks")
+	maxRows               = flag.Int64("embedding_max_rows", 0, "Evict least recently used rows of an embedding table beyond this many, unless the table sets it. If 0, rows are not limited")
+	ttl                   = flag.Int("embedding_ttl", 0, "Evict rows of an embedding table not accessed for this many model versions, unless the table sets it. If 0, rows do not expire")
+	admissionThreshold    = flag.Int("embedding_admission_threshold", 0, "Create the row of an id of an embedding table only after the id is pulled this many times, unless the table sets it. If 0 or 1, admit ids on first pull")
+	admissionSketchWidth  = flag.Int64("embedding_admission_sketch_width", common.DefaultCountMinSketchWidth, "The width of the count-min sketch counting pulls of ids without rows in tables with an admission threshold. It takes 16 bytes per unit of width per table, 16MB by default, and its counts are halved every 10 * width pulls")
+	embeddingDiskDir      = flag.String("embedding_disk_dir", "", "The directory to keep embedding rows beyond the cache of tables with disk storage. If empty, use a temporary directory")
+	traceExporter         = flag.String("trace_exporter", "", "The exporter of OpenTelemetry traces, otlp or stdout. If empty, tracing is disabled")
+	traceEndpoint         = flag.String("trace_endpoint", "", "The OTLP gRPC collector address. If empty, use OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317")
+	traceSampleRatio      = flag.Float64("trace_sample_ratio", 1.0, "The fraction of RPCs to trace unless the caller decides")
+	masterLostTimeout     = flag.Duration("master_lost_timeout", time.Minute, "Outside a Kubernetes cluster, shut down once the master has not been serving for this long")
+	shutdownTimeout       = flag.Duration("shutdown_timeout", 25*time.Second, "The deadline to drain RPCs and save the final checkpoint on SIGTERM or when the master finishes")
+	logLevel              = flag.String("log_level", "info", "The minimum level of logs, one of debug, info, warn and error")
 )
 
 func main() {
 	flag.Parse()
-	address := fmt.Sprintf("%s:%d", os.Getenv("MY_POD_IP"), *port)
+	if err := logging.Setup(*logLevel, "job_name", *jobName); err != nil {
+		log.Fatalf("failed to set up logging: %v", err)
+	}
+	if err := run(); err != nil {
+		logging.Fatal(slog.Default(), "PS failed", "ps_id", *psID, "error", err)
+	}
+}
+
+func run() error {
+	if *traceExporter != "" {
+		shutdown, err := tracing.Setup(*traceExporter, *traceEndpoint, "elasticdl-ps", *traceSampleRatio,
+			attribute.String("job_name", *jobName), attribute.Int("ps_id", *psID))
+		if err != nil {
+			return err
+		}
+		defer shutdown(context.Background())
+	}
+	addr := *address
+	if addr == "" {
+		addr = fmt.Sprintf("%s:%d", os.Getenv("MY_POD_IP"), *port)
+	}
+	// register the pod address, or the listening address which resolves port 0
+	advertiseAddr := ""
+	if *address == "" && os.Getenv("MY_POD_IP") != "" {
+		advertiseAddr = addr
+	}
+	master := *masterAddr
+	dialTimeout := *masterDialTimeout
+	if *standalone {
+		// the default master address is of a job, a standalone PS has no master unless given
+		if !isFlagSet("master_addr") {
+			master = ""
+		}
+		dialTimeout = 0
+	}
 	serverDone := make(chan bool)
-	grpcServer := ps.NewServer(*psID, *optType, *optArgs, *masterAddr, *evaluationSteps,
-		*checkpointDirForInit, *checkpointDir, *checkpointSteps,
-		*keepCheckpointMax, *numPsPods, *lrStalenessModulation).Run(address, *numWorkers, serverDone)
-	log.Println("PS service started at ", address)
-	masterPodName := common.GetMasterPodName(*jobName)
-	clientSet := common.CreateClientSet()
-	done := false
-	for {
-		select {
-		case done = <-serverDone:
-			break
-		default:
-			if common.PodFinished(clientSet, *namespace, masterPodName) {
-				grpcServer.Stop()
-			}
-			time.Sleep(time.Second * 30)
+	psServer, err := ps.NewServer(
+		ps.WithID(*psID, *numPsPods),
+		ps.WithOptimizer(*optType, *optArgs),
+		ps.WithMaster(master, dialTimeout, *evaluationSteps),
+		ps.WithMasterReportTimeout(*masterReportTimeout),
+		ps.WithHeartbeat(advertiseAddr, *heartbeatInterval),
+		ps.WithCheckpointDirForInit(*checkpointDirForInit),
+		ps.WithCheckpoint(*checkpointDir, *checkpointSteps, *keepCheckpointMax),
+		ps.WithLRStalenessModulation(*lrStalenessModulation),
+		ps.WithNumGradThreads(*numGradThreads),
+		ps.WithHogwild(*hogwild),
+		ps.WithEmbeddingDiskDir(*embeddingDiskDir),
+		ps.WithEmbeddingDefaults(&proto.EmbeddingTableInfo{
+			MaxRows:              *maxRows,
+			Ttl:                  int32(*ttl),
+			AdmissionThreshold:   int32(*admissionThreshold),
+			AdmissionSketchWidth: *admissionSketchWidth,
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	if _, err = psServer.Run(addr, *numWorkers, serverDone); err != nil {
+		return err
+	}
+	slog.Info("PS service started", "ps_id", *psID, "address", psServer.Addr(), "standalone", *standalone,
+		"master_addr", master)
+	var httpServer *http.Server
+	if *httpPort != 0 {
+		httpAddress := fmt.Sprintf(":%d", *httpPort)
+		if httpServer, err = psServer.RunHTTP(httpAddress); err != nil {
+			return err
 		}
-		if done {
-			break
+		slog.Info("PS HTTP service started", "ps_id", *psID, "address", httpAddress)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	stop := make(chan struct{})
+	defer close(stop)
+	// in standalone mode, the master is not watched and the nil channel never fires
+	var masterFinished <-chan struct{}
+	if !*standalone {
+		masterFinished = watchMaster(stop, psServer)
+	}
+	var reason string
+	select {
+	case <-serverDone:
+		slog.Info("PS service stopped", "ps_id", *psID)
+		return psServer.Err()
+	case sig := <-signals:
+		reason = sig.String()
+	case <-masterFinished:
+		reason = "master finished"
+	}
+	slog.Info("Shutting down PS", "ps_id", *psID, "reason", reason, "timeout", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	err = psServer.Shutdown(ctx)
+	if httpServer != nil {
+		httpServer.Shutdown(ctx)
+	}
+	if err == nil {
+		slog.Info("PS service shut down", "ps_id", *psID)
+	}
+	return err
+}
+
+// isFlagSet returns whether a flag is given on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+	return set
+}
+
+// watchMaster returns a channel which is closed once the master pod finishes,
+// or outside a Kubernetes cluster, once the master is lost in gRPC health checks
+func watchMaster(stop chan struct{}, psServer *ps.Server) <-chan struct{} {
+	clientSet, err := common.CreateClientSet()
+	if err == nil {
+		return common.WatchPodFinished(stop, clientSet, *namespace, common.GetMasterPodName(*jobName))
 	}
-	log.Println("PS service stopped.")
+	slog.Info("Watching the master with gRPC health checks", "ps_id", *psID, "reason", err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	return psServer.WatchMaster(ctx, *masterLostTimeout)
 }
@@ -0,0 +1,79 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"elasticdl.org/elasticdl/pkg/proto"
+	"google.golang.org/grpc"
+)
+
+var (
+	psAddrs = flag.String("ps_addrs", "localhost:2222", "Comma-separated addresses of the PS pods")
+	tables  = flag.String("tables", "", "Comma-separated names of the embedding tables to describe. If empty, describe all tables")
+	timeout = flag.Duration("timeout", 10*time.Second, "Timeout to get the statistics from a PS pod")
+)
+
+func main() {
+	flag.Parse()
+	var names []string
+	if *tables != "" {
+		names = strings.Split(*tables, ",")
+	}
+	for _, addr := range strings.Split(*psAddrs, ",") {
+		resp, err := getStats(addr, names)
+		if err != nil {
+			log.Fatalf("Failed to get embedding table statistics from %s: %v", addr, err)
+		}
+		fmt.Printf("PS %s\n", addr)
+		printStats(resp.Tables)
+	}
+}
+
+func getStats(addr string, names []string) (*proto.GetEmbeddingTableStatsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	client := proto.NewPserverClient(conn)
+	return client.GetEmbeddingTableStats(ctx, &proto.GetEmbeddingTableStatsRequest{Names: names})
+}
+
+func printStats(stats []*proto.EmbeddingTableStats) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDIM\tDTYPE\tINITIALIZER\tROWS\tDISK_ROWS\tMEMORY_BYTES\tCREATED_ROWS\tPULLS\tPUSHES\tEVICTED_EXPIRED\tEVICTED_LRU\tKEY_COLLISIONS")
+	for _, s := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%v\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", s.Name, s.Dim, s.Dtype, s.Initializer,
+			s.Rows, s.DiskRows, s.MemoryBytes, s.CreatedRows, s.Pulls, s.Pushes, s.EvictedExpiredRows,
+			s.EvictedLruRows, s.KeyCollisions)
+	}
+	w.Flush()
+	for _, s := range stats {
+		fmt.Printf("Access histogram of %s:\n", s.Name)
+		for i, n := range s.AccessHistogram {
+			fmt.Printf("  %d-%d accesses: %d rows\n", int64(1)<<uint(i), int64(1)<<uint(i+1)-1, n)
+		}
+	}
+}
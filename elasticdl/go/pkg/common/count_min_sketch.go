@@ -0,0 +1,101 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+const (
+	countMinSketchDepth = 4
+	// DefaultCountMinSketchWidth is the default number of counters of each hash function,
+	// a sketch of this width takes 16MB
+	DefaultCountMinSketchWidth = 1 << 20
+	// countMinSketchDecay is the number of adds, in multiples of the width, after which
+	// the counters are halved
+	countMinSketchDecay = 10
+)
+
+// CountMinSketch estimates how many times ids are seen in constant memory, 4 counters
+// of 4 bytes per unit of width. Every 10 * width adds, all counters are halved, so that
+// counts of ids no longer seen decay and the sketch does not fill up with collisions.
+// An estimate is never smaller than the count halved alike, ids only collide upwards.
+// It is safe for concurrent use.
+type CountMinSketch struct {
+	seed     uint64
+	width    uint64
+	counters []uint32
+	adds     uint64
+}
+
+// NewCountMinSketch creates a count-min sketch, the seed decides the hash functions.
+// If width is not positive, it is DefaultCountMinSketchWidth.
+func NewCountMinSketch(seed int64, width int64) *CountMinSketch {
+	if width <= 0 {
+		width = DefaultCountMinSketchWidth
+	}
+	return &CountMinSketch{
+		seed:     uint64(seed),
+		width:    uint64(width),
+		counters: make([]uint32, countMinSketchDepth*width),
+	}
+}
+
+// Add counts a new occurrence of id and returns the estimated count of id
+func (s *CountMinSketch) Add(id int64) uint32 {
+	var estimate uint32 = math.MaxUint32
+	h := mix64(s.seed ^ mix64(uint64(id)))
+	for i := uint64(0); i < countMinSketchDepth; i++ {
+		counter := &s.counters[i*s.width+h%s.width]
+		count := atomic.LoadUint32(counter)
+		if count < math.MaxUint32 {
+			count = atomic.AddUint32(counter, 1)
+		}
+		if count < estimate {
+			estimate = count
+		}
+		h = mix64(h)
+	}
+	if atomic.AddUint64(&s.adds, 1)%(countMinSketchDecay*s.width) == 0 {
+		s.halve()
+	}
+	return estimate
+}
+
+// halve halves all counters
+func (s *CountMinSketch) halve() {
+	for i := range s.counters {
+		for {
+			count := atomic.LoadUint32(&s.counters[i])
+			if atomic.CompareAndSwapUint32(&s.counters[i], count, count/2) {
+				break
+			}
+		}
+	}
+}
+
+// Count returns the estimated count of id
+func (s *CountMinSketch) Count(id int64) uint32 {
+	var estimate uint32 = math.MaxUint32
+	h := mix64(s.seed ^ mix64(uint64(id)))
+	for i := uint64(0); i < countMinSketchDepth; i++ {
+		count := atomic.LoadUint32(&s.counters[i*s.width+h%s.width])
+		if count < estimate {
+			estimate = count
+		}
+		h = mix64(h)
+	}
+	return estimate
+}
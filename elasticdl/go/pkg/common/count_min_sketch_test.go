@@ -0,0 +1,46 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	s := NewCountMinSketch(1, 0)
+	assert.Len(t, s.counters, countMinSketchDepth*DefaultCountMinSketchWidth)
+	assert.Equal(t, uint32(0), s.Count(7))
+	assert.Equal(t, uint32(1), s.Add(7))
+	assert.Equal(t, uint32(2), s.Add(7))
+	assert.Equal(t, uint32(2), s.Count(7))
+	for i := int64(0); i < 10000; i++ {
+		s.Add(i + 100)
+	}
+	assert.True(t, s.Count(7) >= 2)
+	assert.True(t, s.Count(-1) <= 1)
+}
+
+func TestCountMinSketchDecay(t *testing.T) {
+	s := NewCountMinSketch(1, 16)
+	assert.Len(t, s.counters, countMinSketchDepth*16)
+	for i := 0; i < 159; i++ {
+		s.Add(7)
+	}
+	assert.Equal(t, uint32(159), s.Count(7))
+	// counters are halved every 160 adds
+	assert.Equal(t, uint32(160), s.Add(7))
+	assert.Equal(t, uint32(80), s.Count(7))
+}
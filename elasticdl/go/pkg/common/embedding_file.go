@@ -0,0 +1,108 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"os"
+)
+
+// diskRow locates a row in an embedding file and keeps its last access
+type diskRow struct {
+	slot     int64
+	tick     int64
+	version  int32
+	accesses uint32
+}
+
+// embeddingFile stores embedding rows in fixed-size slots of a file, the index
+// of the rows is kept in memory. Slots of removed rows are reused. It is not
+// safe for concurrent use, except that rows can be read concurrently.
+type embeddingFile struct {
+	file      *os.File
+	rowBytes  int64
+	rows      map[int64]diskRow
+	numSlots  int64
+	freeSlots []int64
+}
+
+// openEmbeddingFile creates an empty embedding file, an existing file is truncated
+func openEmbeddingFile(path string, rowBytes int64) (*embeddingFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &embeddingFile{
+		file:     file,
+		rowBytes: rowBytes,
+		rows:     make(map[int64]diskRow),
+	}, nil
+}
+
+// get returns the location of a row
+func (f *embeddingFile) get(index int64) (diskRow, bool) {
+	row, ok := f.rows[index]
+	return row, ok
+}
+
+// read reads a row into dst
+func (f *embeddingFile) read(row diskRow, dst []byte) error {
+	_, err := f.file.ReadAt(dst, row.slot*f.rowBytes)
+	return err
+}
+
+// write writes the row of an index with its last access and number of accesses
+func (f *embeddingFile) write(index int64, src []byte, tick int64, version int32, accesses uint32) error {
+	row, ok := f.rows[index]
+	if !ok {
+		if n := len(f.freeSlots); n > 0 {
+			row.slot = f.freeSlots[n-1]
+			f.freeSlots = f.freeSlots[:n-1]
+		} else {
+			row.slot = f.numSlots
+			f.numSlots++
+		}
+	}
+	if _, err := f.file.WriteAt(src, row.slot*f.rowBytes); err != nil {
+		if !ok {
+			f.freeSlots = append(f.freeSlots, row.slot)
+		}
+		return err
+	}
+	row.tick = tick
+	row.version = version
+	row.accesses = accesses
+	f.rows[index] = row
+	return nil
+}
+
+// remove removes the row of an index and frees its slot
+func (f *embeddingFile) remove(index int64) {
+	if row, ok := f.rows[index]; ok {
+		delete(f.rows, index)
+		f.freeSlots = append(f.freeSlots, row.slot)
+	}
+}
+
+// len returns the number of rows
+func (f *embeddingFile) len() int {
+	return len(f.rows)
+}
+
+// close closes and removes the file
+func (f *embeddingFile) close() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.file.Name())
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// KeyFingerprint returns the 64-bit fingerprint of a string key
+func KeyFingerprint(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64())
+}
+
+// embeddingKeys maps the string keys of an embedding table to ids. A key gets its
+// fingerprint as id, or the next free id after it if another key has taken it, so
+// different keys never share a row. Since the id of a key then depends on the keys
+// before it, ids are saved in checkpoints and kept on restore. A key is pinned while
+// a pull uses its id, so that it is not removed under the pull. It is safe for
+// concurrent use.
+type embeddingKeys struct {
+	lock       sync.RWMutex
+	ids        map[string]int64
+	keys       map[int64]string
+	pins       map[int64]int32 // number of pulls using each id
+	collisions int64
+}
+
+func newEmbeddingKeys() *embeddingKeys {
+	return &embeddingKeys{
+		ids:  make(map[string]int64),
+		keys: make(map[int64]string),
+		pins: make(map[int64]int32),
+	}
+}
+
+// probe returns the id a new key would get, the caller holds the lock
+func (k *embeddingKeys) probe(key string) int64 {
+	id := KeyFingerprint(key)
+	for {
+		if _, ok := k.keys[id]; !ok {
+			return id
+		}
+		id++
+	}
+}
+
+// getIDs returns the ids of keys. New keys are given ids if create is set, otherwise
+// they get the ids they would be given.
+func (k *embeddingKeys) getIDs(keys []string, create bool) []int64 {
+	ids := make([]int64, len(keys))
+	var missing []int
+	k.lock.RLock()
+	for i, key := range keys {
+		if id, ok := k.ids[key]; ok {
+			ids[i] = id
+		} else if create {
+			missing = append(missing, i)
+		} else {
+			ids[i] = k.probe(key)
+		}
+	}
+	k.lock.RUnlock()
+	if len(missing) == 0 {
+		return ids
+	}
+	k.lock.Lock()
+	for _, i := range missing {
+		id, ok := k.ids[keys[i]]
+		if !ok {
+			id = k.probe(keys[i])
+			if id != KeyFingerprint(keys[i]) {
+				k.collisions++
+			}
+			k.add(keys[i], id)
+		}
+		ids[i] = id
+	}
+	k.lock.Unlock()
+	return ids
+}
+
+// add gives a key an id, the caller holds the lock for write
+func (k *embeddingKeys) add(key string, id int64) {
+	k.ids[key] = id
+	k.keys[id] = key
+}
+
+// pin returns the ids of keys and pins them, new keys are given ids. Each pin is
+// released by release.
+func (k *embeddingKeys) pin(keys []string) []int64 {
+	ids := make([]int64, len(keys))
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for i, key := range keys {
+		id, ok := k.ids[key]
+		if !ok {
+			id = k.probe(key)
+			if id != KeyFingerprint(key) {
+				k.collisions++
+			}
+			k.add(key, id)
+		}
+		k.pins[id]++
+		ids[i] = id
+	}
+	return ids
+}
+
+// release releases the pins of ids, and removes the keys no longer pinned which have no
+// row. The caller holds the locks of the shards of ids, so that rows are not created
+// in between.
+func (k *embeddingKeys) release(ids []int64, hasRow func(int64) bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, id := range ids {
+		if k.pins[id]--; k.pins[id] > 0 {
+			continue
+		}
+		delete(k.pins, id)
+		if key, ok := k.keys[id]; ok && !hasRow(id) {
+			delete(k.keys, id)
+			delete(k.ids, key)
+		}
+	}
+}
+
+// setIDs gives keys the ids they had, as saved in a checkpoint, and returns their ids.
+// A key whose id is taken by another key is given a new id.
+func (k *embeddingKeys) setIDs(keys []string, ids []int64) []int64 {
+	result := make([]int64, len(keys))
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for i, key := range keys {
+		id, ok := k.ids[key]
+		if !ok {
+			id = ids[i]
+			if _, taken := k.keys[id]; taken {
+				id = k.probe(key)
+				k.collisions++
+			}
+			k.add(key, id)
+		}
+		result[i] = id
+	}
+	return result
+}
+
+// getKey returns the key of an id
+func (k *embeddingKeys) getKey(id int64) (string, bool) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// remove removes the keys of ids, except pinned ones which are removed on release
+func (k *embeddingKeys) remove(ids []int64) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, id := range ids {
+		if key, ok := k.keys[id]; ok && k.pins[id] == 0 {
+			delete(k.keys, id)
+			delete(k.ids, key)
+		}
+	}
+}
+
+// numCollisions returns the number of keys whose fingerprints were taken by other keys
+func (k *embeddingKeys) numCollisions() int64 {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.collisions
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddingKeys(t *testing.T) {
+	k := newEmbeddingKeys()
+	ids := k.getIDs([]string{"a", "b", "a"}, true)
+	assert.Equal(t, []int64{KeyFingerprint("a"), KeyFingerprint("b"), KeyFingerprint("a")}, ids)
+
+	// a key whose fingerprint is taken gets the next free id
+	k.keys[KeyFingerprint("c")] = "x"
+	k.keys[KeyFingerprint("c")+1] = "y"
+	assert.Equal(t, []int64{KeyFingerprint("c") + 2}, k.getIDs([]string{"c"}, false))
+	assert.Equal(t, int64(0), k.numCollisions())
+	assert.Equal(t, []int64{KeyFingerprint("c") + 2}, k.getIDs([]string{"c"}, true))
+	assert.Equal(t, int64(1), k.numCollisions())
+	key, ok := k.getKey(KeyFingerprint("c") + 2)
+	assert.True(t, ok)
+	assert.Equal(t, "c", key)
+
+	k.remove([]int64{KeyFingerprint("a")})
+	_, ok = k.getKey(KeyFingerprint("a"))
+	assert.False(t, ok)
+	assert.Len(t, k.ids, 2)
+
+	// pinned keys are removed once released if they have no row
+	ids = k.pin([]string{"d"})
+	k.pin([]string{"d"})
+	k.remove(ids)
+	k.release(ids, func(int64) bool { return false })
+	_, ok = k.getKey(ids[0])
+	assert.True(t, ok)
+	k.release(ids, func(int64) bool { return false })
+	_, ok = k.getKey(ids[0])
+	assert.False(t, ok)
+	ids = k.pin([]string{"d"})
+	k.release(ids, func(int64) bool { return true })
+	_, ok = k.getKey(ids[0])
+	assert.True(t, ok)
+	assert.Len(t, k.pins, 0)
+
+	// keys keep the ids they are set with unless another key has taken them
+	k = newEmbeddingKeys()
+	k.getIDs([]string{"a"}, true)
+	ids = k.setIDs([]string{"b", "c"}, []int64{KeyFingerprint("b") + 1, KeyFingerprint("a")})
+	assert.Equal(t, []int64{KeyFingerprint("b") + 1, KeyFingerprint("c")}, ids)
+	assert.Equal(t, int64(1), k.numCollisions())
+}
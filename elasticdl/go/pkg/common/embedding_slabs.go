@@ -0,0 +1,92 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+// slabBytes is the size of a slab, a contiguous memory block holding many rows
+const slabBytes = 64 * 1024
+
+// embeddingSlabs stores embedding rows in slabs. Each id is mapped to a slot,
+// the position of its row in the slabs, and slots of removed rows are reused.
+// Slabs are never moved or freed, so row views stay valid until the row is
+// removed. It is not safe for concurrent use.
+type embeddingSlabs struct {
+	rowBytes  int64
+	slabRows  int64
+	slots     map[int64]int64
+	slabs     [][]byte
+	numSlots  int64
+	freeSlots []int64
+}
+
+func newEmbeddingSlabs(rowBytes int64) *embeddingSlabs {
+	slabRows := int64(1)
+	if rowBytes > 0 && rowBytes < slabBytes {
+		slabRows = slabBytes / rowBytes
+	}
+	return &embeddingSlabs{
+		rowBytes: rowBytes,
+		slabRows: slabRows,
+		slots:    make(map[int64]int64),
+	}
+}
+
+// get returns the slot of an id
+func (s *embeddingSlabs) get(index int64) (int64, bool) {
+	slot, ok := s.slots[index]
+	return slot, ok
+}
+
+// add allocates a slot for a new id and returns it. The row of a reused slot
+// keeps the values of the removed row until it is initialized.
+func (s *embeddingSlabs) add(index int64) int64 {
+	var slot int64
+	if n := len(s.freeSlots); n > 0 {
+		slot = s.freeSlots[n-1]
+		s.freeSlots = s.freeSlots[:n-1]
+	} else {
+		slot = s.numSlots
+		if slot == int64(len(s.slabs))*s.slabRows {
+			s.slabs = append(s.slabs, make([]byte, s.slabRows*s.rowBytes))
+		}
+		s.numSlots++
+	}
+	s.slots[index] = slot
+	return slot
+}
+
+// remove removes an id and frees its slot
+func (s *embeddingSlabs) remove(index int64) {
+	if slot, ok := s.slots[index]; ok {
+		delete(s.slots, index)
+		s.freeSlots = append(s.freeSlots, slot)
+	}
+}
+
+// row returns the view of the bytes of the row in a slot
+func (s *embeddingSlabs) row(slot int64) []byte {
+	slab := s.slabs[slot/s.slabRows]
+	begin := slot % s.slabRows * s.rowBytes
+	end := begin + s.rowBytes
+	return slab[begin:end:end]
+}
+
+// memoryBytes returns the size of the slabs
+func (s *embeddingSlabs) memoryBytes() int64 {
+	return int64(len(s.slabs)) * s.slabRows * s.rowBytes
+}
+
+// len returns the number of rows
+func (s *embeddingSlabs) len() int {
+	return len(s.slots)
+}
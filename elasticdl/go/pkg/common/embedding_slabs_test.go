@@ -0,0 +1,48 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmbeddingSlabs(t *testing.T) {
+	s := newEmbeddingSlabs(slabBytes)
+	assert.Equal(t, int64(1), s.slabRows)
+	for i := int64(0); i < 3; i++ {
+		assert.Equal(t, i, s.add(i*10))
+	}
+	assert.Len(t, s.slabs, 3)
+	copy(s.row(1), []byte{1, 2})
+	assert.Equal(t, []byte{1, 2}, s.row(1)[:2])
+
+	s.remove(10)
+	assert.Equal(t, 2, s.len())
+	_, ok := s.get(10)
+	assert.False(t, ok)
+	assert.Equal(t, int64(1), s.add(30))
+	slot, ok := s.get(30)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), slot)
+	assert.Len(t, s.slabs, 3)
+
+	s = newEmbeddingSlabs(16)
+	s.add(1)
+	s.add(2)
+	assert.Len(t, s.slabs, 1)
+	assert.Len(t, s.row(0), 16)
+	assert.Equal(t, 16, cap(s.row(0)))
+}
@@ -14,75 +14,1038 @@
 package common
 
 import (
-	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/types_go_proto"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+
+	"elasticdl.org/elasticdl/pkg/proto"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/types_go_proto"
 )
 
-// EmbeddingTable struct
+const (
+	// numEmbeddingShards is the number of shards of an embedding table, each shard has its own lock
+	numEmbeddingShards = 16
+	// lruEvictDivisor divides MaxRows or CacheRows into the number of rows freed beyond
+	// it once it is exceeded, so that eviction does not run on every new row
+	lruEvictDivisor = 10
+	// lruSampleSize is the number of rows sampled to estimate the least recently used rows
+	lruSampleSize = 4096
+)
+
+// EmbeddingTable struct. Ids are partitioned across shards with their own locks, so accesses
+// to different shards do not block each other. Rows are stored in slabs, and a vector returned
+// by reference is a view of its row, which is valid until the row is removed or moved to disk.
+// Rows of a quantized table are stored in StorageDtype and dequantized into Dtype on access.
 type EmbeddingTable struct {
-	Dim              int64
-	Initializer      string
-	EmbeddingVectors map[int64]*Tensor
-	Dtype            types_go_proto.DataType
-	lock             sync.RWMutex
+	Dim                  int64
+	Initializer          string
+	Dtype                types_go_proto.DataType
+	StorageDtype         types_go_proto.DataType // Half or Int8 quantizes the float32 rows, otherwise it is Dtype
+	Seed                 int64
+	MaxRows              int64 // evicts least recently used rows beyond it, 0 means unlimited
+	TTL                  int32 // evicts rows not accessed for TTL model versions, 0 means never
+	AdmissionThreshold   int32 // pulls of an id before its row is created, 0 or 1 creates it on first pull
+	AdmissionSketchWidth int64 // width of the count-min sketch counting pulls, 0 means the default
+	CacheRows            int64 // keeps at most CacheRows rows in memory and the others on disk, 0 keeps all in memory
+	KeyType              proto.EmbeddingKeyType
+	initializerFn        InitializerFactory
+	quantized            bool
+	shards               []*embeddingShard
+	evictable            bool
+	accessClock          int64
+	accessVersion        int32
+	evictionLock         sync.Mutex
+	ttlScanVersion       int32
+	evictedExpired       int64
+	evictedLRU           int64
+	admission            *CountMinSketch // nil if every id is admitted
+	diskErrLock          sync.Mutex
+	diskErr              error          // the first disk error not reported yet
+	keys                 *embeddingKeys // nil unless the table has string keys
+	pulls                int64
+	pushes               int64
+	createdRows          int64 // rows initialized since the last checkpoint
+}
+
+// embeddingShard holds the rows of the ids mapped to it
+type embeddingShard struct {
+	lock           sync.RWMutex
+	rows           *embeddingSlabs
+	accessCounts   []uint32       // number of accesses of each slot
+	accessTicks    []int64        // last access of each slot
+	accessVersions []int32        // model version of the last access of each slot
+	disk           *embeddingFile // rows not in memory, nil if all rows are in memory
+}
+
+// EvictionStats counts rows evicted from an embedding table
+type EvictionStats struct {
+	Expired           int64
+	LeastRecentlyUsed int64
+}
+
+func newEmbeddingShards(rowBytes int64) []*embeddingShard {
+	shards := make([]*embeddingShard, numEmbeddingShards)
+	for i := range shards {
+		shards[i] = &embeddingShard{rows: newEmbeddingSlabs(rowBytes)}
+	}
+	return shards
+}
+
+// NewEmbeddingTable creates an embedding table instance, see NewEmbeddingTableFromInfo
+func NewEmbeddingTable(dim int64, initializer string, dtype types_go_proto.DataType) (*EmbeddingTable, error) {
+	return NewEmbeddingTableFromInfo(&proto.EmbeddingTableInfo{Dim: dim, Initializer: initializer, Dtype: dtype})
+}
+
+// NewEmbeddingTableFromInfo creates an embedding table instance from its info. Unless the initializer
+// gives a non-zero seed, the table seed is derived from the table name, so tables are initialized differently.
+func NewEmbeddingTableFromInfo(info *proto.EmbeddingTableInfo) (*EmbeddingTable, error) {
+	initializerFn, seed, err := ParseInitializer(info.Initializer, info.Dim)
+	if err != nil {
+		return nil, fmt.Errorf("Embedding table %s: %v", info.Name, err)
+	}
+	if seed == 0 {
+		h := fnv.New64a()
+		h.Write([]byte(info.Name))
+		seed = int64(h.Sum64())
+	}
+	storage := info.StorageDtype
+	if storage == types_go_proto.DataType_DT_INVALID {
+		storage = info.Dtype
+	}
+	if storage != info.Dtype && (info.Dtype != Float32 || storage != Half && storage != Int8) {
+		return nil, fmt.Errorf("Embedding table %s: unsupported storage dtype %v for dtype %v",
+			info.Name, storage, info.Dtype)
+	}
+	e := &EmbeddingTable{
+		Dim:           info.Dim,
+		Initializer:   info.Initializer,
+		Dtype:         info.Dtype,
+		StorageDtype:  storage,
+		Seed:          seed,
+		MaxRows:       info.MaxRows,
+		TTL:           info.Ttl,
+		CacheRows:     info.CacheRows,
+		KeyType:       info.KeyType,
+		initializerFn: initializerFn,
+		quantized:     storage != info.Dtype,
+		shards:        newEmbeddingShards(storageRowBytes(info.Dim, storage)),
+		evictable:     info.MaxRows > 0 || info.Ttl > 0 || info.CacheRows > 0,
+	}
+	if info.AdmissionThreshold > 1 {
+		e.AdmissionThreshold = info.AdmissionThreshold
+		e.AdmissionSketchWidth = info.AdmissionSketchWidth
+		e.admission = NewCountMinSketch(seed, info.AdmissionSketchWidth)
+	}
+	if info.KeyType == proto.EmbeddingKeyType_STRING_KEY {
+		e.keys = newEmbeddingKeys()
+	}
+	return e, nil
+}
+
+// OpenDiskStorage creates the files in dir to keep the rows beyond CacheRows.
+// It is called before the table is used.
+func (e *EmbeddingTable) OpenDiskStorage(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, shard := range e.shards {
+		disk, err := openEmbeddingFile(filepath.Join(dir, fmt.Sprintf("shard-%d", i)), e.rowBytes())
+		if err != nil {
+			return err
+		}
+		shard.disk = disk
+	}
+	return nil
+}
+
+// rowBytes returns the size of a row in storage
+func (e *EmbeddingTable) rowBytes() int64 {
+	return storageRowBytes(e.Dim, e.StorageDtype)
+}
+
+// vector returns a row as a vector, which is the view of the row unless the table is quantized
+func (e *EmbeddingTable) vector(row []byte) *Tensor {
+	if !e.quantized {
+		return &Tensor{Buffer: row, Dims: []int64{e.Dim}, Dtype: e.Dtype}
+	}
+	vector := NewEmptyVector(e.Dim, e.Dtype)
+	dequantizeRow(e.StorageDtype, row, vector.Buffer)
+	return vector
+}
+
+// initRow initializes the row of an index in storage. The initial value only depends on the
+// table seed and the index, so it does not change with the access order or across restarts.
+func (e *EmbeddingTable) initRow(index int64, row []byte) {
+	if !e.quantized {
+		e.initializerFn(RowSeed(e.Seed, index))(e.vector(row))
+		return
+	}
+	vector := NewEmptyVector(e.Dim, e.Dtype)
+	e.initializerFn(RowSeed(e.Seed, index))(vector)
+	quantizeRow(e.StorageDtype, vector.Buffer, row)
+}
+
+// Close removes the disk storage of the table
+func (e *EmbeddingTable) Close() error {
+	for _, shard := range e.shards {
+		shard.lock.Lock()
+		if shard.disk != nil {
+			if err := shard.disk.close(); err != nil {
+				shard.lock.Unlock()
+				return err
+			}
+			shard.disk = nil
+		}
+		shard.lock.Unlock()
+	}
+	return nil
+}
+
+// setDiskErr keeps a disk error until EvictRows reports it
+func (e *EmbeddingTable) setDiskErr(err error) {
+	e.diskErrLock.Lock()
+	if e.diskErr == nil {
+		e.diskErr = err
+	}
+	e.diskErrLock.Unlock()
+}
+
+// HashID hashes an id, so that ids already sharded across PS pods by modulo
+// spread evenly when they are partitioned again by modulo
+func HashID(id int64) uint64 {
+	return mix64(uint64(id))
+}
+
+// shardIndex returns the shard of an index. Ids are hashed first, since they
+// are often sharded across PS pods by modulo already.
+func shardIndex(index int64) int {
+	return int(HashID(index) % numEmbeddingShards)
+}
+
+// groupByShard returns the positions of indices in each shard
+func groupByShard(indices []int64) [][]int {
+	groups := make([][]int, numEmbeddingShards)
+	for i, index := range indices {
+		s := shardIndex(index)
+		groups[s] = append(groups[s], i)
+	}
+	return groups
 }
 
-// NewEmbeddingTable creates an embedding table instance
-func NewEmbeddingTable(dim int64, initializer string, dtype types_go_proto.DataType) *EmbeddingTable {
-	return &EmbeddingTable{
-		Dim:              dim,
-		Initializer:      initializer,
-		EmbeddingVectors: make(map[int64]*Tensor),
-		Dtype:            dtype,
+// Len returns the number of rows in the table
+func (e *EmbeddingTable) Len() int {
+	num := 0
+	for _, shard := range e.shards {
+		shard.lock.RLock()
+		num += shard.len()
+		shard.lock.RUnlock()
 	}
+	return num
 }
 
-// GetEmbeddingVector returns an REFERENCE of embedding vector giving an index
+// len returns the number of rows in memory and on disk, the caller holds the shard lock
+func (shard *embeddingShard) len() int {
+	if shard.disk == nil {
+		return shard.rows.len()
+	}
+	return shard.rows.len() + shard.disk.len()
+}
+
+// remove removes the row of an index from memory and disk, the caller holds the shard lock for write
+func (shard *embeddingShard) remove(index int64) {
+	shard.rows.remove(index)
+	if shard.disk != nil {
+		shard.disk.remove(index)
+	}
+}
+
+// Contains returns whether the table has the row of an index
+func (e *EmbeddingTable) Contains(index int64) bool {
+	shard := e.shards[shardIndex(index)]
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	return shard.contains(index)
+}
+
+// contains returns whether the shard has the row of an index, the caller holds the shard lock
+func (shard *embeddingShard) contains(index int64) bool {
+	if _, ok := shard.rows.get(index); ok {
+		return true
+	}
+	if shard.disk != nil {
+		_, ok := shard.disk.get(index)
+		return ok
+	}
+	return false
+}
+
+// GetEmbeddingVector returns an REFERENCE of embedding vector giving an index.
+// The vector of a quantized table is a COPY, see PutEmbeddingVectorRefs.
 func (e *EmbeddingTable) GetEmbeddingVector(index int64) *Tensor {
-	e.lock.RLock()
-	if value, ok := e.EmbeddingVectors[index]; ok {
-		e.lock.RUnlock()
-		return value
+	shard := e.shards[shardIndex(index)]
+	shard.lock.RLock()
+	row := e.getRow(shard, index)
+	shard.lock.RUnlock()
+	if row != nil {
+		return e.vector(row)
+	}
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if row := e.getRow(shard, index); row != nil {
+		return e.vector(row)
+	}
+	return e.vector(e.addRow(shard, index))
+}
+
+// getRow returns the view of an existing row in storage and records the access, or nil
+// if the row does not exist. The caller holds the shard lock.
+func (e *EmbeddingTable) getRow(shard *embeddingShard, index int64) []byte {
+	slot, ok := shard.rows.get(index)
+	if !ok {
+		return nil
+	}
+	atomic.AddUint32(&shard.accessCounts[slot], 1)
+	if e.evictable {
+		atomic.StoreInt64(&shard.accessTicks[slot], atomic.AddInt64(&e.accessClock, 1))
+		atomic.StoreInt32(&shard.accessVersions[slot], atomic.LoadInt32(&e.accessVersion))
 	}
-	e.lock.RUnlock()
-	newVector := NewEmptyVector(e.Dim, e.Dtype)
-	e.lock.Lock()
-	// TODO(qijun) only support uniform initializer
-	if e.Initializer == "uniform" {
-		initializerFn := RandomUniform(-0.05, 0.05, int64(len(e.EmbeddingVectors)))
-		initializerFn(newVector)
+	return shard.rows.row(slot)
+}
+
+// addRow adds a row to memory and returns its view. A row on disk is moved to memory, otherwise
+// the row is initialized. The caller holds the shard lock for write.
+func (e *EmbeddingTable) addRow(shard *embeddingShard, index int64) []byte {
+	slot := shard.rows.add(index)
+	if slot == int64(len(shard.accessCounts)) {
+		shard.accessCounts = append(shard.accessCounts, 0)
+		if e.evictable {
+			shard.accessTicks = append(shard.accessTicks, 0)
+			shard.accessVersions = append(shard.accessVersions, 0)
+		}
+	}
+	shard.accessCounts[slot] = 1
+	if e.evictable {
+		shard.accessTicks[slot] = atomic.AddInt64(&e.accessClock, 1)
+		shard.accessVersions[slot] = atomic.LoadInt32(&e.accessVersion)
 	}
-	e.EmbeddingVectors[index] = newVector
-	e.lock.Unlock()
-	return newVector
+	row := shard.rows.row(slot)
+	if shard.disk != nil {
+		if diskRow, ok := shard.disk.get(index); ok {
+			err := shard.disk.read(diskRow, row)
+			shard.disk.remove(index)
+			if err == nil {
+				shard.accessCounts[slot] += diskRow.accesses
+				return row
+			}
+			e.setDiskErr(err)
+		}
+	}
+	e.initRow(index, row)
+	atomic.AddInt64(&e.createdRows, 1)
+	return row
 }
 
-// GetEmbeddingVectors returns COPYS of embedding vectors giving an array of indices
+// GetEmbeddingVectorRefs returns REFERENCES of embedding vectors giving an array of indices.
+// Unlike calling GetEmbeddingVector in a loop, it takes the lock of each shard once.
+// The vectors of a quantized table are COPIES, which PutEmbeddingVectorRefs writes back.
+func (e *EmbeddingTable) GetEmbeddingVectorRefs(indices []int64) []*Tensor {
+	vectors := make([]*Tensor, len(indices))
+	for s, positions := range groupByShard(indices) {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := e.shards[s]
+		var missing []int
+		shard.lock.RLock()
+		for _, i := range positions {
+			if row := e.getRow(shard, indices[i]); row != nil {
+				vectors[i] = e.vector(row)
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		shard.lock.RUnlock()
+		if len(missing) == 0 {
+			continue
+		}
+		shard.lock.Lock()
+		for _, i := range missing {
+			row := e.getRow(shard, indices[i])
+			if row == nil {
+				row = e.addRow(shard, indices[i])
+			}
+			vectors[i] = e.vector(row)
+		}
+		shard.lock.Unlock()
+	}
+	if e.quantized {
+		// duplicate indices share a copy, as they share a view otherwise
+		copies := make(map[int64]*Tensor, len(indices))
+		for i, index := range indices {
+			if vector, ok := copies[index]; ok {
+				vectors[i] = vector
+			} else {
+				copies[index] = vectors[i]
+			}
+		}
+	}
+	return vectors
+}
+
+// PutEmbeddingVectorRefs writes back the vectors from GetEmbeddingVectorRefs once they are
+// updated, which requantizes the rows of a quantized table. Other tables update their rows
+// in place, so it does nothing for them. Rows removed in between are skipped.
+func (e *EmbeddingTable) PutEmbeddingVectorRefs(indices []int64, vectors []*Tensor) {
+	if !e.quantized {
+		return
+	}
+	for s, positions := range groupByShard(indices) {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := e.shards[s]
+		shard.lock.Lock()
+		for _, i := range positions {
+			if slot, ok := shard.rows.get(indices[i]); ok {
+				quantizeRow(e.StorageDtype, vectors[i].Buffer, shard.rows.row(slot))
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// GetEmbeddingVectors returns COPYS of embedding vectors giving an array of indices.
+// With an admission threshold, it counts the pulls of ids without rows and returns
+// zero vectors for them until they are admitted.
 func (e *EmbeddingTable) GetEmbeddingVectors(indices []int64) *Tensor {
 	dim := []int64{int64(len(indices)), e.Dim}
 	tensor := NewEmptyTensor(dim, e.Dtype)
-	for i, index := range indices {
-		tensor.SetRow(int64(i), e.GetEmbeddingVector(index))
+	e.pullRows(indices, func(i int, row []byte) {
+		dequantizeRow(e.StorageDtype, row, tensor.GetRow(int64(i)).Buffer)
+	})
+	return tensor
+}
+
+// GetCompactEmbeddingVectors is GetEmbeddingVectors returning the rows in StorageDtype.
+// A row of an Int8 table has Dim + 8 values, the float32 scale and offset are in its
+// first 8 bytes.
+func (e *EmbeddingTable) GetCompactEmbeddingVectors(indices []int64) *Tensor {
+	rowBytes := e.rowBytes()
+	dim := []int64{int64(len(indices)), rowBytes / int64(DtypeSize[e.StorageDtype])}
+	tensor := NewEmptyTensor(dim, e.StorageDtype)
+	e.pullRows(indices, func(i int, row []byte) {
+		copy(tensor.Buffer[int64(i)*rowBytes:], row)
+	})
+	return tensor
+}
+
+// pullRows calls visit with the rows of indices, which are created if they do not exist and
+// are admitted. visit is called with the position of each index, under the shard lock.
+func (e *EmbeddingTable) pullRows(indices []int64, visit func(i int, row []byte)) {
+	atomic.AddInt64(&e.pulls, 1)
+	for s, positions := range groupByShard(indices) {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := e.shards[s]
+		var missing []int
+		shard.lock.RLock()
+		for _, i := range positions {
+			if row := e.getRow(shard, indices[i]); row != nil {
+				visit(i, row)
+			} else {
+				missing = append(missing, i)
+			}
+		}
+		shard.lock.RUnlock()
+		if e.admission != nil {
+			admitted := missing[:0]
+			for _, i := range missing {
+				if e.admission.Add(indices[i]) >= uint32(e.AdmissionThreshold) {
+					admitted = append(admitted, i)
+				}
+			}
+			missing = admitted
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		shard.lock.Lock()
+		for _, i := range missing {
+			row := e.getRow(shard, indices[i])
+			if row == nil {
+				row = e.addRow(shard, indices[i])
+			}
+			visit(i, row)
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// LookupEmbeddingVectors returns COPYS of embedding vectors giving an array of indices.
+// It neither creates rows nor counts as an access of the rows. Missing ids get the values
+// their rows would be initialized with, or zero vectors if the table has an admission threshold.
+func (e *EmbeddingTable) LookupEmbeddingVectors(indices []int64) *Tensor {
+	dim := []int64{int64(len(indices)), e.Dim}
+	tensor := NewEmptyTensor(dim, e.Dtype)
+	row := make([]byte, e.rowBytes())
+	atomic.AddInt64(&e.pulls, 1)
+	for s, positions := range groupByShard(indices) {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := e.shards[s]
+		shard.lock.RLock()
+		for _, i := range positions {
+			dst := tensor.GetRow(int64(i)).Buffer
+			if slot, ok := shard.rows.get(indices[i]); ok {
+				dequantizeRow(e.StorageDtype, shard.rows.row(slot), dst)
+			} else if e.readDiskRow(shard, indices[i], row) {
+				dequantizeRow(e.StorageDtype, row, dst)
+			} else if e.admission == nil {
+				e.initRow(indices[i], row)
+				dequantizeRow(e.StorageDtype, row, dst)
+			}
+		}
+		shard.lock.RUnlock()
 	}
 	return tensor
 }
 
-// SetEmbeddingVectors sets (indices, value) pair to embedding vector
+// readDiskRow reads the row of an index on disk into dst and returns whether the row is on disk.
+// The caller holds the shard lock.
+func (e *EmbeddingTable) readDiskRow(shard *embeddingShard, index int64, dst []byte) bool {
+	if shard.disk == nil {
+		return false
+	}
+	row, ok := shard.disk.get(index)
+	if !ok {
+		return false
+	}
+	if err := shard.disk.read(row, dst); err != nil {
+		e.setDiskErr(err)
+	}
+	return true
+}
+
+// FilterAdmittedRows returns the rows of the indexed slices whose ids have rows in the table.
+// Gradients of ids not admitted yet are dropped by it.
+func (e *EmbeddingTable) FilterAdmittedRows(slices *IndexedSlices) *IndexedSlices {
+	if e.admission == nil {
+		return slices
+	}
+	var rows []int64
+	for i, index := range slices.Ids {
+		if e.Contains(index) {
+			rows = append(rows, int64(i))
+		}
+	}
+	if len(rows) == len(slices.Ids) {
+		return slices
+	}
+	tensor := NewEmptyTensor([]int64{int64(len(rows)), e.Dim}, slices.ConcatTensors.Dtype)
+	ids := make([]int64, len(rows))
+	for i, row := range rows {
+		tensor.SetRow(int64(i), slices.ConcatTensors.GetRow(row))
+		ids[i] = slices.Ids[row]
+	}
+	return NewIndexedSlices(tensor, ids)
+}
+
+// SetEmbeddingVectors sets (indices, value) pair to embedding vector. Rows with keys
+// keep their ids if they have both, as in a checkpoint, and are given ids otherwise.
 func (e *EmbeddingTable) SetEmbeddingVectors(idxslice *IndexedSlices) error {
-	for i, index := range idxslice.Ids {
-		value := e.GetEmbeddingVector(index)
+	ids := idxslice.Ids
+	if idxslice.Keys != nil {
+		if e.keys == nil {
+			return fmt.Errorf("Embedding table does not have string keys")
+		}
+		if len(ids) == len(idxslice.Keys) {
+			ids = e.keys.setIDs(idxslice.Keys, ids)
+		} else {
+			ids = e.keys.getIDs(idxslice.Keys, true)
+		}
+	}
+	vectors := e.GetEmbeddingVectorRefs(ids)
+	for i, value := range vectors {
 		copy(value.Buffer, idxslice.ConcatTensors.GetRow(int64(i)).Buffer)
 	}
+	e.PutEmbeddingVectorRefs(ids, vectors)
 	return nil
 }
 
-// ToIndexedSlices transforms embedding table format to indexed slices format
+// KeyIDs returns the ids of string keys, new keys are given ids. With an admission
+// threshold the keys are pinned, and the caller releases them with ReleaseKeys.
+func (e *EmbeddingTable) KeyIDs(keys []string) ([]int64, error) {
+	if e.keys == nil {
+		return nil, fmt.Errorf("Embedding table does not have string keys")
+	}
+	if e.admission != nil {
+		return e.keys.pin(keys), nil
+	}
+	return e.keys.getIDs(keys, true), nil
+}
+
+// LookupKeyIDs returns the ids of string keys without giving ids to new keys. A new key
+// gets the id it would be given, which has no row.
+func (e *EmbeddingTable) LookupKeyIDs(keys []string) ([]int64, error) {
+	if e.keys == nil {
+		return nil, fmt.Errorf("Embedding table does not have string keys")
+	}
+	return e.keys.getIDs(keys, false), nil
+}
+
+// ResolveKeys returns the indexed slices with the ids of their keys. New keys are given
+// ids, unless the table has an admission threshold, so that gradients of keys not admitted
+// yet are dropped by FilterAdmittedRows.
+func (e *EmbeddingTable) ResolveKeys(slices *IndexedSlices) (*IndexedSlices, error) {
+	if slices.Keys == nil {
+		return slices, nil
+	}
+	if e.keys == nil {
+		return nil, fmt.Errorf("Embedding table does not have string keys")
+	}
+	ids := e.keys.getIDs(slices.Keys, e.admission == nil)
+	return &IndexedSlices{ConcatTensors: slices.ConcatTensors, Ids: ids, Keys: slices.Keys}, nil
+}
+
+// ReleaseKeys releases the keys pinned by KeyIDs, given the ids of a pull. Keys not
+// pinned by other pulls whose rows were not created, as they are not admitted yet, are
+// removed and given ids again on their next pull. Each shard is locked while its keys
+// are released, so that no row is created for a removed key.
+func (e *EmbeddingTable) ReleaseKeys(ids []int64) {
+	if e.keys == nil || e.admission == nil {
+		return
+	}
+	for s, positions := range groupByShard(ids) {
+		if len(positions) == 0 {
+			continue
+		}
+		shardIDs := make([]int64, len(positions))
+		for i, p := range positions {
+			shardIDs[i] = ids[p]
+		}
+		shard := e.shards[s]
+		shard.lock.Lock()
+		e.keys.release(shardIDs, shard.contains)
+		shard.lock.Unlock()
+	}
+}
+
+// KeyCollisions returns the number of string keys whose fingerprints collided with other keys
+func (e *EmbeddingTable) KeyCollisions() int64 {
+	if e.keys == nil {
+		return 0
+	}
+	return e.keys.numCollisions()
+}
+
+// ToIndexedSlices transforms embedding table format to indexed slices format.
+// It does not count as an access of the rows. Shards are copied one by one, so
+// only one shard is locked at a time.
 func (e *EmbeddingTable) ToIndexedSlices() *IndexedSlices {
-	e.lock.RLock()
-	ids := make([]int64, 0, len(e.EmbeddingVectors))
-	for k := range e.EmbeddingVectors {
-		ids = append(ids, k)
+	var ids []int64
+	buffer := []byte{}
+	vector := NewEmptyVector(e.Dim, e.Dtype)
+	row := make([]byte, e.rowBytes())
+	for _, shard := range e.shards {
+		shard.lock.RLock()
+		for index, slot := range shard.rows.slots {
+			dequantizeRow(e.StorageDtype, shard.rows.row(slot), vector.Buffer)
+			ids = append(ids, index)
+			buffer = append(buffer, vector.Buffer...)
+		}
+		if shard.disk != nil {
+			for index := range shard.disk.rows {
+				e.readDiskRow(shard, index, row)
+				dequantizeRow(e.StorageDtype, row, vector.Buffer)
+				ids = append(ids, index)
+				buffer = append(buffer, vector.Buffer...)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	tensor := &Tensor{
+		Buffer: buffer,
+		Dims:   []int64{int64(len(ids)), e.Dim},
+		Dtype:  e.Dtype,
+	}
+	slices := NewIndexedSlices(tensor, ids)
+	if e.keys != nil {
+		slices = e.withKeys(slices)
+	}
+	return slices
+}
+
+// withKeys returns the indexed slices with the keys of their ids, so that checkpoints
+// keep the ids of keys. Rows without keys are dropped.
+func (e *EmbeddingTable) withKeys(slices *IndexedSlices) *IndexedSlices {
+	keys := make([]string, 0, len(slices.Ids))
+	var rows []int64
+	for i, id := range slices.Ids {
+		if key, ok := e.keys.getKey(id); ok {
+			keys = append(keys, key)
+			rows = append(rows, int64(i))
+		}
+	}
+	if len(rows) == len(slices.Ids) {
+		slices.Keys = keys
+		return slices
+	}
+	tensor := NewEmptyTensor([]int64{int64(len(rows)), e.Dim}, e.Dtype)
+	ids := make([]int64, len(rows))
+	for i, row := range rows {
+		tensor.SetRow(int64(i), slices.ConcatTensors.GetRow(row))
+		ids[i] = slices.Ids[row]
+	}
+	return &IndexedSlices{ConcatTensors: tensor, Ids: ids, Keys: keys}
+}
+
+// RemoveEmbeddingVectors removes embedding vectors giving an array of indices
+func (e *EmbeddingTable) RemoveEmbeddingVectors(indices []int64) {
+	for s, positions := range groupByShard(indices) {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := e.shards[s]
+		shard.lock.Lock()
+		for _, i := range positions {
+			shard.remove(indices[i])
+		}
+		shard.lock.Unlock()
+	}
+	if e.keys != nil {
+		e.keys.remove(indices)
+	}
+}
+
+// EvictionEnabled returns whether the table has an eviction policy or disk storage
+func (e *EmbeddingTable) EvictionEnabled() bool {
+	return e.evictable
+}
+
+// rowAccess is the last access of a row in memory or on disk
+type rowAccess struct {
+	index   int64
+	tick    int64
+	version int32
+}
+
+// EvictRows removes expired and least recently used rows and returns their indices.
+// version is the current model version, rows accessed from now on are stamped with it.
+// A row expires when it has not been accessed for more than TTL versions. Expired rows
+// are looked for every TTL/2 versions, so they may stay up to TTL/2 versions longer.
+// Once the table holds more than MaxRows rows, least recently used rows are removed
+// until a tenth of MaxRows is free. An evicted row is initialized again on next access.
+// With disk storage, least recently used rows beyond CacheRows are then moved to disk
+// in the same way, and their indices are returned as well. Least recently used rows
+// are estimated from a sample of lruSampleSize rows, so they are exact in smaller
+// tables. It returns the first disk error since the last call, if any. Shards are
+// locked one at a time, so that pulls of other shards are not blocked.
+func (e *EmbeddingTable) EvictRows(version int32) (evicted []int64, moved []int64, err error) {
+	if !e.evictable {
+		return nil, nil, nil
+	}
+	e.evictionLock.Lock()
+	defer e.evictionLock.Unlock()
+	atomic.StoreInt32(&e.accessVersion, version)
+	if e.ttlScanDue(version) {
+		atomic.StoreInt32(&e.ttlScanVersion, version)
+		evicted = e.removeRows(func(row rowAccess) bool { return version-row.version > e.TTL })
+		e.evictedExpired += int64(len(evicted))
+	}
+	if e.MaxRows > 0 {
+		if tick, ok := e.lruTick(e.MaxRows, true); ok {
+			lru := e.removeRows(func(row rowAccess) bool { return row.tick <= tick })
+			evicted = append(evicted, lru...)
+			e.evictedLRU += int64(len(lru))
+		}
+	}
+	if e.CacheRows > 0 && e.shards[0].disk != nil {
+		if tick, ok := e.lruTick(e.CacheRows, false); ok {
+			moved, err = e.moveRowsToDiskBefore(tick)
+		}
+	}
+	e.diskErrLock.Lock()
+	if err == nil {
+		err = e.diskErr
+	}
+	e.diskErr = nil
+	e.diskErrLock.Unlock()
+	return evicted, moved, err
+}
+
+// EvictionDue stamps rows accessed from now on with version, like EvictRows, and returns
+// whether EvictRows has rows to evict or move to disk, or a disk error to return. It only
+// locks shards for read, so that callers may check it before waiting for updates to evict.
+func (e *EmbeddingTable) EvictionDue(version int32) bool {
+	if !e.evictable {
+		return false
+	}
+	atomic.StoreInt32(&e.accessVersion, version)
+	if e.ttlScanDue(version) {
+		return true
+	}
+	e.diskErrLock.Lock()
+	diskErr := e.diskErr
+	e.diskErrLock.Unlock()
+	if diskErr != nil {
+		return true
+	}
+	var numRows, numCached int64
+	for _, shard := range e.shards {
+		shard.lock.RLock()
+		numRows += int64(shard.len())
+		numCached += int64(shard.rows.len())
+		shard.lock.RUnlock()
+	}
+	return (e.MaxRows > 0 && numRows > e.MaxRows) ||
+		(e.CacheRows > 0 && e.shards[0].disk != nil && numCached > e.CacheRows)
+}
+
+// ttlScanDue returns whether expired rows are looked for at version
+func (e *EmbeddingTable) ttlScanDue(version int32) bool {
+	return e.TTL > 0 && version-atomic.LoadInt32(&e.ttlScanVersion) >= (e.TTL+1)/2
+}
+
+// lruTick returns the last access at or before which rows are the least recently used
+// rows beyond limit, so that limit/lruEvictDivisor rows are free without them, or false
+// if there are at most limit rows. Rows on disk are counted if withDisk is set. The access
+// is estimated from a sample of lruSampleSize rows, taken from each shard in proportion.
+func (e *EmbeddingTable) lruTick(limit int64, withDisk bool) (int64, bool) {
+	numRows := make([]int, len(e.shards))
+	total := 0
+	for i, shard := range e.shards {
+		shard.lock.RLock()
+		numRows[i] = shard.rows.len()
+		if withDisk && shard.disk != nil {
+			numRows[i] += shard.disk.len()
+		}
+		shard.lock.RUnlock()
+		total += numRows[i]
+	}
+	if int64(total) <= limit {
+		return 0, false
+	}
+	var ticks []int64
+	for i, shard := range e.shards {
+		n := numRows[i]
+		if total > lruSampleSize {
+			n = (numRows[i]*lruSampleSize + total - 1) / total
+		}
+		shard.lock.RLock()
+		ticks = shard.sampleTicks(ticks, n, withDisk)
+		shard.lock.RUnlock()
+	}
+	if len(ticks) == 0 {
+		return 0, false
+	}
+	sort.Slice(ticks, func(i, j int) bool { return ticks[i] < ticks[j] })
+	excess := int64(total) - (limit - limit/lruEvictDivisor)
+	n := (excess*int64(len(ticks)) + int64(total) - 1) / int64(total)
+	if n > int64(len(ticks)) {
+		n = int64(len(ticks))
+	}
+	return ticks[n-1], true
+}
+
+// sampleTicks appends the last accesses of about n rows of the shard to ticks, rows on
+// disk in proportion if withDisk is set. The caller holds the shard lock.
+func (shard *embeddingShard) sampleTicks(ticks []int64, n int, withDisk bool) []int64 {
+	numMemory := n
+	if withDisk && shard.disk != nil && shard.len() > 0 {
+		numMemory = (n*shard.rows.len() + shard.len() - 1) / shard.len()
+	}
+	i := 0
+	for _, slot := range shard.rows.slots {
+		if i == numMemory {
+			break
+		}
+		ticks = append(ticks, atomic.LoadInt64(&shard.accessTicks[slot]))
+		i++
+	}
+	if withDisk && shard.disk != nil {
+		for _, row := range shard.disk.rows {
+			if i >= n {
+				break
+			}
+			ticks = append(ticks, row.tick)
+			i++
+		}
+	}
+	return ticks
+}
+
+// removeRows removes the rows in memory and on disk which match, and their keys,
+// and returns their indices. Shards are locked one at a time.
+func (e *EmbeddingTable) removeRows(match func(rowAccess) bool) []int64 {
+	var removed []int64
+	for _, shard := range e.shards {
+		shard.lock.Lock()
+		start := len(removed)
+		for index, slot := range shard.rows.slots {
+			if match(rowAccess{index, shard.accessTicks[slot], shard.accessVersions[slot]}) {
+				removed = append(removed, index)
+			}
+		}
+		if shard.disk != nil {
+			for index, row := range shard.disk.rows {
+				if match(rowAccess{index, row.tick, row.version}) {
+					removed = append(removed, index)
+				}
+			}
+		}
+		for _, index := range removed[start:] {
+			shard.remove(index)
+		}
+		if e.keys != nil {
+			e.keys.remove(removed[start:])
+		}
+		shard.lock.Unlock()
+	}
+	return removed
+}
+
+// moveRowsToDiskBefore moves the rows in memory last accessed at or before tick to disk
+// and returns their indices. Shards are locked one at a time.
+func (e *EmbeddingTable) moveRowsToDiskBefore(tick int64) ([]int64, error) {
+	var moved []int64
+	for _, shard := range e.shards {
+		shard.lock.Lock()
+		start := len(moved)
+		for index, slot := range shard.rows.slots {
+			if shard.accessTicks[slot] <= tick {
+				moved = append(moved, index)
+			}
+		}
+		for i, index := range moved[start:] {
+			if err := shard.moveToDisk(index); err != nil {
+				shard.lock.Unlock()
+				return moved[:start+i], err
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return moved, nil
+}
+
+// MoveRowsToDisk moves the rows of indices in memory to disk, e.g. to follow the rows
+// another table moved in EvictRows. Rows not in memory are skipped, and so are all rows
+// of a table without disk storage.
+func (e *EmbeddingTable) MoveRowsToDisk(indices []int64) error {
+	for s, positions := range groupByShard(indices) {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := e.shards[s]
+		shard.lock.Lock()
+		for _, i := range positions {
+			if _, ok := shard.rows.get(indices[i]); !ok || shard.disk == nil {
+				continue
+			}
+			if err := shard.moveToDisk(indices[i]); err != nil {
+				shard.lock.Unlock()
+				return err
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return nil
+}
+
+// moveToDisk moves the row of an index from memory to disk, the caller holds the shard lock for write
+func (shard *embeddingShard) moveToDisk(index int64) error {
+	slot, _ := shard.rows.get(index)
+	err := shard.disk.write(index, shard.rows.row(slot), shard.accessTicks[slot], shard.accessVersions[slot],
+		shard.accessCounts[slot])
+	if err != nil {
+		return err
+	}
+	shard.rows.remove(index)
+	return nil
+}
+
+// GetEvictionStats returns the numbers of rows evicted from the table
+func (e *EmbeddingTable) GetEvictionStats() EvictionStats {
+	e.evictionLock.Lock()
+	defer e.evictionLock.Unlock()
+	return EvictionStats{
+		Expired:           e.evictedExpired,
+		LeastRecentlyUsed: e.evictedLRU,
+	}
+}
+
+// EmbeddingTableStats describes the size and the usage of an embedding table
+type EmbeddingTableStats struct {
+	Rows            int64
+	DiskRows        int64   // rows on disk, included in Rows
+	MemoryBytes     int64   // memory of the rows and their access records, without the maps of ids
+	CreatedRows     int64   // rows initialized since the last checkpoint
+	Pulls           int64   // pulls of vectors, including read-only pulls
+	Pushes          int64   // pushes of gradients
+	AccessHistogram []int64 // AccessHistogram[i] rows were accessed between 2^i and 2^(i+1)-1 times
+	Eviction        EvictionStats
+	KeyCollisions   int64
+}
+
+// RecordPush counts a push of gradients to the table
+func (e *EmbeddingTable) RecordPush() {
+	atomic.AddInt64(&e.pushes, 1)
+}
+
+// ResetCreatedRows restarts counting the rows created, once the table is checkpointed
+func (e *EmbeddingTable) ResetCreatedRows() {
+	atomic.StoreInt64(&e.createdRows, 0)
+}
+
+// MemoryBytes returns the memory of the rows and their access records, without the maps of ids
+func (e *EmbeddingTable) MemoryBytes() int64 {
+	var bytes int64
+	for _, shard := range e.shards {
+		shard.lock.RLock()
+		bytes += shard.rows.memoryBytes() + int64(len(shard.accessCounts))*4 +
+			int64(len(shard.accessTicks))*8 + int64(len(shard.accessVersions))*4
+		shard.lock.RUnlock()
+	}
+	return bytes
+}
+
+// GetStats returns the statistics of the table. Only one shard is locked at a time.
+func (e *EmbeddingTable) GetStats() EmbeddingTableStats {
+	stats := EmbeddingTableStats{
+		CreatedRows:   atomic.LoadInt64(&e.createdRows),
+		Pulls:         atomic.LoadInt64(&e.pulls),
+		Pushes:        atomic.LoadInt64(&e.pushes),
+		Eviction:      e.GetEvictionStats(),
+		MemoryBytes:   e.MemoryBytes(),
+		KeyCollisions: e.KeyCollisions(),
+	}
+	histogram := make([]int64, 33)
+	for _, shard := range e.shards {
+		shard.lock.RLock()
+		stats.Rows += int64(shard.len())
+		for _, slot := range shard.rows.slots {
+			histogram[bits.Len32(atomic.LoadUint32(&shard.accessCounts[slot]))]++
+		}
+		if shard.disk != nil {
+			stats.DiskRows += int64(shard.disk.len())
+			for _, row := range shard.disk.rows {
+				histogram[bits.Len32(row.accesses)]++
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	// rows are accessed at least once when they are created
+	histogram = histogram[1:]
+	n := len(histogram)
+	for n > 0 && histogram[n-1] == 0 {
+		n--
 	}
-	e.lock.RUnlock()
-	return NewIndexedSlices(e.GetEmbeddingVectors(ids), ids)
+	stats.AccessHistogram = histogram[:n]
+	return stats
 }
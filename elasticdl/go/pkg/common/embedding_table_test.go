@@ -14,19 +14,27 @@
 package common
 
 import (
-	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"elasticdl.org/elasticdl/pkg/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/types_go_proto"
 )
 
 func TestEmbeddingTableInit(t *testing.T) {
-	e1 := NewEmbeddingTable(2, "zero", Float32)
+	e1, err := NewEmbeddingTable(2, "zero", Float32)
+	assert.Nil(t, err)
 	v1 := e1.GetEmbeddingVector(10)
-	assert.Contains(t, e1.EmbeddingVectors, int64(10))
+	assert.True(t, e1.Contains(10))
 	assert.Equal(t, Slice(v1).([]float32), []float32{0, 0}, "NewEmbeddingTable FAIL")
 }
 
 func TestEmbeddingTableGet(t *testing.T) {
-	e1 := NewEmbeddingTable(2, "zero", Float32)
+	e1, err := NewEmbeddingTable(2, "zero", Float32)
+	assert.Nil(t, err)
 	v1 := e1.GetEmbeddingVector(1) // Note: this is a reference type, future changes have effect on it
 	t1 := NewTensor([]float32{1, 2}, []int64{1, 2})
 	it := NewIndexedSlices(t1, []int64{1})
@@ -39,13 +47,14 @@ func TestEmbeddingTableGet(t *testing.T) {
 }
 
 func TestEmbeddingTableSet(t *testing.T) {
-	e := NewEmbeddingTable(2, "zero", Float32)
+	e, err := NewEmbeddingTable(2, "zero", Float32)
+	assert.Nil(t, err)
 	i := []int64{1, 3, 5}
 	v := []float32{1.0, 2.0, 3.0, 4.0, 5.0, 6.0}
 	tensor := NewTensor(v, []int64{3, 2})
 	it := NewIndexedSlices(tensor, i)
 
-	err := e.SetEmbeddingVectors(it)
+	err = e.SetEmbeddingVectors(it)
 	assert.Nil(t, err)
 
 	v1 := e.GetEmbeddingVector(1)
@@ -57,3 +66,309 @@ func TestEmbeddingTableSet(t *testing.T) {
 	v5 := e.GetEmbeddingVector(5)
 	assert.True(t, CompareFloatArray([]float32{5.0, 6.0}, Slice(v5).([]float32), 0.0001), "SetEmbeddingVector FAIL")
 }
+
+func TestEmbeddingTableInitOrder(t *testing.T) {
+	e1, err := NewEmbeddingTable(4, "random_normal;seed=3", Float32)
+	assert.Nil(t, err)
+	e2, err := NewEmbeddingTable(4, "random_normal;seed=3", Float32)
+	assert.Nil(t, err)
+	e1.GetEmbeddingVectors([]int64{1, 2, 3})
+	e2.GetEmbeddingVectors([]int64{3, 2, 1})
+	for _, id := range []int64{1, 2, 3} {
+		assert.Equal(t, Slice(e1.GetEmbeddingVector(id)), Slice(e2.GetEmbeddingVector(id)))
+	}
+	assert.NotEqual(t, Slice(e1.GetEmbeddingVector(1)), Slice(e1.GetEmbeddingVector(2)))
+
+	e3, err := NewEmbeddingTable(4, "random_normal;seed=4", Float32)
+	assert.Nil(t, err)
+	assert.NotEqual(t, Slice(e1.GetEmbeddingVector(1)), Slice(e3.GetEmbeddingVector(1)))
+
+	// initializers are parsed as in NewEmbeddingTableFromInfo
+	e4, err := NewEmbeddingTable(2, "Ones", Float32)
+	assert.Nil(t, err)
+	assert.Equal(t, []float32{1, 1}, Slice(e4.GetEmbeddingVector(1)))
+	_, err = NewEmbeddingTable(2, "orthogonal", Float32)
+	assert.NotNil(t, err)
+}
+
+func TestEmbeddingTableEviction(t *testing.T) {
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "zero", Dtype: Float32, Ttl: 2}
+	e, err := NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, err)
+	assert.True(t, e.EvictionEnabled())
+	evict := func(version int32) []int64 {
+		ids, moved, err := e.EvictRows(version)
+		assert.Nil(t, err)
+		assert.Empty(t, moved)
+		return ids
+	}
+	e.GetEmbeddingVectors([]int64{1, 2, 3})
+	assert.Empty(t, evict(1))
+	e.GetEmbeddingVector(1)
+	assert.Empty(t, evict(2))
+	assert.ElementsMatch(t, []int64{2, 3}, evict(3))
+	assert.False(t, e.EvictionDue(3))
+	assert.Equal(t, 1, e.Len())
+	e.ToIndexedSlices()
+	assert.True(t, e.EvictionDue(5))
+	assert.Equal(t, []int64{1}, evict(5))
+	assert.Equal(t, EvictionStats{Expired: 3}, e.GetEvictionStats())
+
+	info = &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "zero", Dtype: Float32, MaxRows: 20}
+	e, err = NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, err)
+	for i := int64(0); i < 20; i++ {
+		e.GetEmbeddingVector(i)
+	}
+	e.GetEmbeddingVectors([]int64{0, 1})
+	assert.False(t, e.EvictionDue(1))
+	assert.Empty(t, evict(1))
+	e.GetEmbeddingVector(20)
+	assert.True(t, e.EvictionDue(2))
+	assert.ElementsMatch(t, []int64{2, 3, 4}, evict(2))
+	assert.False(t, e.EvictionDue(2))
+	assert.Equal(t, 18, e.Len())
+	assert.True(t, e.Contains(0))
+	assert.Equal(t, EvictionStats{LeastRecentlyUsed: 3}, e.GetEvictionStats())
+
+	// least recently used rows of larger tables are estimated from a sample
+	info.MaxRows = 4 * lruSampleSize
+	e, err = NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, err)
+	for i := int64(0); i < 5*lruSampleSize; i++ {
+		e.GetEmbeddingVector(i)
+	}
+	evicted := evict(1)
+	expected := 5*lruSampleSize - (info.MaxRows - info.MaxRows/lruEvictDivisor)
+	assert.InDelta(t, expected, len(evicted), float64(expected)/10)
+	assert.True(t, e.Contains(5*lruSampleSize-1))
+	assert.False(t, e.Contains(0))
+
+	e, err = NewEmbeddingTable(2, "zero", Float32)
+	assert.Nil(t, err)
+	e.GetEmbeddingVector(1)
+	assert.False(t, e.EvictionEnabled())
+	assert.False(t, e.EvictionDue(100))
+	assert.Empty(t, evict(100))
+}
+
+func TestEmbeddingTableAdmission(t *testing.T) {
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "ones", Dtype: Float32, AdmissionThreshold: 2}
+	e, err := NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, err)
+	v := e.GetEmbeddingVectors([]int64{1, 2})
+	assert.Equal(t, []float32{0, 0, 0, 0}, Slice(v).([]float32))
+	assert.Equal(t, 0, e.Len())
+
+	v = e.GetEmbeddingVectors([]int64{1, 3})
+	assert.Equal(t, []float32{1, 1, 0, 0}, Slice(v).([]float32))
+	assert.Equal(t, 1, e.Len())
+
+	grad := NewIndexedSlices(NewTensor([]float32{1, 2, 3, 4}, []int64{2, 2}), []int64{3, 1})
+	admitted := e.FilterAdmittedRows(grad)
+	assert.Equal(t, []int64{1}, admitted.Ids)
+	assert.Equal(t, []float32{3, 4}, Slice(admitted.ConcatTensors).([]float32))
+}
+
+func TestLookupEmbeddingVectors(t *testing.T) {
+	e, err := NewEmbeddingTable(2, "random_uniform;seed=1", Float32)
+	assert.Nil(t, err)
+	v1 := e.GetEmbeddingVector(1)
+	copy(v1.Buffer, NewTensor([]float32{1, 2}, []int64{2}).Buffer)
+	v := e.LookupEmbeddingVectors([]int64{1, 2})
+	assert.Equal(t, 1, e.Len())
+	expected := append([]float32{1, 2}, Slice(e.GetEmbeddingVector(2)).([]float32)...)
+	assert.Equal(t, expected, Slice(v).([]float32))
+
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "ones", Dtype: Float32, AdmissionThreshold: 2}
+	e, _ = NewEmbeddingTableFromInfo(info)
+	v = e.LookupEmbeddingVectors([]int64{1})
+	assert.Equal(t, []float32{0, 0}, Slice(v).([]float32))
+	assert.Equal(t, uint32(0), e.admission.Count(1))
+}
+
+func TestEmbeddingTableDiskStorage(t *testing.T) {
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "ones", Dtype: Float32, CacheRows: 20}
+	e, err := NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, err)
+	dir, err := ioutil.TempDir("", "embedding_table_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, e.OpenDiskStorage(dir))
+	defer e.Close()
+	for i := int64(0); i < 40; i++ {
+		copy(e.GetEmbeddingVector(i).Buffer, NewTensor([]float32{float32(i), 1}, []int64{2}).Buffer)
+	}
+	evicted, moved, err := e.EvictRows(1)
+	assert.Nil(t, err)
+	assert.Empty(t, evicted)
+	assert.Len(t, moved, 22)
+	assert.Equal(t, 40, e.Len())
+	numCached := 0
+	for _, shard := range e.shards {
+		numCached += shard.rows.len()
+	}
+	assert.Equal(t, 18, numCached)
+	assert.True(t, e.Contains(0))
+
+	// another table follows the rows moved
+	other, err := NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, err)
+	assert.Nil(t, other.OpenDiskStorage(filepath.Join(dir, "other")))
+	defer other.Close()
+	other.GetEmbeddingVectors([]int64{moved[0], moved[1], 39})
+	assert.Nil(t, other.MoveRowsToDisk(append(moved, 40)))
+	assert.Equal(t, int64(2), other.GetStats().DiskRows)
+	assert.Equal(t, 3, other.Len())
+
+	v := e.LookupEmbeddingVectors([]int64{0, 39, 40})
+	assert.Equal(t, []float32{0, 1, 39, 1, 1, 1}, Slice(v).([]float32))
+	assert.Equal(t, []float32{3, 1}, Slice(e.GetEmbeddingVector(3)).([]float32))
+	assert.Equal(t, 40, e.Len())
+
+	slices := e.ToIndexedSlices()
+	assert.Len(t, slices.Ids, 40)
+	for i, id := range slices.Ids {
+		assert.Equal(t, []float32{float32(id), 1}, Slice(slices.ConcatTensors.GetRow(int64(i))).([]float32))
+	}
+
+	e.RemoveEmbeddingVectors([]int64{0, 3})
+	assert.Equal(t, 38, e.Len())
+	assert.False(t, e.Contains(0))
+	assert.Equal(t, []float32{1, 1}, Slice(e.GetEmbeddingVector(0)).([]float32))
+}
+
+func TestQuantizedEmbeddingTable(t *testing.T) {
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 4, Initializer: "ones", Dtype: Float64, StorageDtype: Int8}
+	_, err := NewEmbeddingTableFromInfo(info)
+	assert.NotNil(t, err)
+
+	values := []float32{-1, 0.5, 0.25, 1}
+	for _, storage := range []types_go_proto.DataType{Half, Int8} {
+		info = &proto.EmbeddingTableInfo{Name: "e", Dim: 4, Initializer: "ones", Dtype: Float32, StorageDtype: storage}
+		e, err := NewEmbeddingTableFromInfo(info)
+		assert.Nil(t, err)
+		assert.Equal(t, []float32{1, 1, 1, 1}, Slice(e.GetEmbeddingVector(1)).([]float32))
+
+		e.SetEmbeddingVectors(NewIndexedSlices(NewTensor(values, []int64{1, 4}), []int64{2}))
+		assert.InDeltaSlice(t, values, Slice(e.GetEmbeddingVector(2)).([]float32), 0.005)
+
+		// vectors by reference are copies until they are put back
+		refs := e.GetEmbeddingVectorRefs([]int64{1})
+		copy(refs[0].Buffer, NewVector(values).Buffer)
+		assert.Equal(t, []float32{1, 1, 1, 1}, Slice(e.GetEmbeddingVector(1)).([]float32))
+		e.PutEmbeddingVectorRefs([]int64{1}, refs)
+		assert.InDeltaSlice(t, values, Slice(e.GetEmbeddingVector(1)).([]float32), 0.005)
+
+		v := e.GetEmbeddingVectors([]int64{2, 3})
+		assert.InDeltaSlice(t, append(values, 1, 1, 1, 1), Slice(v).([]float32), 0.005)
+		assert.Equal(t, 3, e.Len())
+
+		compact := e.GetCompactEmbeddingVectors([]int64{2})
+		assert.Equal(t, storage, compact.Dtype)
+		assert.Equal(t, int64(len(compact.Buffer)), e.rowBytes())
+		dst := NewEmptyVector(4, Float32)
+		dequantizeRow(storage, compact.Buffer, dst.Buffer)
+		assert.InDeltaSlice(t, values, Slice(dst).([]float32), 0.005)
+
+		slices := e.ToIndexedSlices()
+		assert.Equal(t, Float32, slices.ConcatTensors.Dtype)
+		assert.Equal(t, []int64{3, 4}, slices.ConcatTensors.Dims)
+	}
+	info.StorageDtype = Half
+	e, _ := NewEmbeddingTableFromInfo(info)
+	assert.Equal(t, []int64{1, 4}, e.GetCompactEmbeddingVectors([]int64{1}).Dims)
+	info.StorageDtype = Int8
+	e, _ = NewEmbeddingTableFromInfo(info)
+	assert.Equal(t, []int64{1, 12}, e.GetCompactEmbeddingVectors([]int64{1}).Dims)
+}
+
+func TestEmbeddingTableStringKeys(t *testing.T) {
+	e, err := NewEmbeddingTable(2, "zero", Float32)
+	assert.Nil(t, err)
+	_, err = e.KeyIDs([]string{"a"})
+	assert.NotNil(t, err)
+
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 1, Initializer: "zero", Dtype: Float32,
+		KeyType: proto.EmbeddingKeyType_STRING_KEY}
+	e, _ = NewEmbeddingTableFromInfo(info)
+	slices := &IndexedSlices{ConcatTensors: NewTensor([]float32{1, 2}, []int64{2, 1}), Keys: []string{"a", "b"}}
+	assert.Nil(t, e.SetEmbeddingVectors(slices))
+	ids, _ := e.LookupKeyIDs([]string{"b", "c"})
+	assert.Equal(t, []float32{2, 0}, Slice(e.LookupEmbeddingVectors(ids)).([]float32))
+	assert.Equal(t, 2, e.Len())
+
+	saved := e.ToIndexedSlices()
+	assert.Len(t, saved.Keys, 2)
+	for i, key := range saved.Keys {
+		ids, _ := e.LookupKeyIDs([]string{key})
+		assert.Equal(t, ids[0], saved.Ids[i])
+	}
+
+	// a restored key keeps its id, even if it was given after a collision
+	saved.Ids[0]++
+	restored, _ := NewEmbeddingTableFromInfo(info)
+	assert.Nil(t, restored.SetEmbeddingVectors(saved))
+	restoredIDs, _ := restored.LookupKeyIDs(saved.Keys[:1])
+	assert.Equal(t, saved.Ids[0], restoredIDs[0])
+
+	e.RemoveEmbeddingVectors(ids[:1])
+	_, ok := e.keys.getKey(ids[0])
+	assert.False(t, ok)
+
+	// keys of gradients are resolved, keys pulled but not admitted are released
+	info.AdmissionThreshold = 2
+	e, _ = NewEmbeddingTableFromInfo(info)
+	grad, err := e.ResolveKeys(&IndexedSlices{ConcatTensors: NewTensor([]float32{1}, []int64{1, 1}), Keys: []string{"a"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{KeyFingerprint("a")}, grad.Ids)
+	assert.Len(t, e.keys.ids, 0)
+	ids, _ = e.KeyIDs([]string{"a"})
+	e.GetEmbeddingVectors(ids)
+	e.ReleaseKeys(ids)
+	assert.Len(t, e.keys.ids, 0)
+	ids, _ = e.KeyIDs([]string{"a"})
+	e.GetEmbeddingVectors(ids)
+	e.ReleaseKeys(ids)
+	assert.Len(t, e.keys.ids, 1)
+	assert.True(t, e.Contains(ids[0]))
+
+	// a key is kept until the last pull using it is released
+	first, _ := e.KeyIDs([]string{"b"})
+	second, _ := e.KeyIDs([]string{"b"})
+	e.ReleaseKeys(first)
+	assert.Len(t, e.keys.ids, 2)
+	e.ReleaseKeys(second)
+	assert.Len(t, e.keys.ids, 1)
+}
+
+func TestEmbeddingTableStats(t *testing.T) {
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "zero", Dtype: Float32, CacheRows: 2}
+	e, _ := NewEmbeddingTableFromInfo(info)
+	dir, err := ioutil.TempDir("", "embedding_table_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, e.OpenDiskStorage(dir))
+	defer e.Close()
+
+	e.GetEmbeddingVectors([]int64{1, 2, 3})
+	e.GetEmbeddingVectors([]int64{1, 1, 2})
+	e.LookupEmbeddingVectors([]int64{4})
+	e.RecordPush()
+	stats := e.GetStats()
+	assert.Equal(t, int64(3), stats.Rows)
+	assert.Equal(t, int64(3), stats.CreatedRows)
+	assert.Equal(t, int64(3), stats.Pulls)
+	assert.Equal(t, int64(1), stats.Pushes)
+	assert.Equal(t, []int64{1, 2}, stats.AccessHistogram)
+	assert.True(t, stats.MemoryBytes >= 3*8)
+
+	_, _, err = e.EvictRows(1)
+	assert.Nil(t, err)
+	e.ResetCreatedRows()
+	stats = e.GetStats()
+	assert.Equal(t, int64(3), stats.Rows)
+	assert.Equal(t, int64(1), stats.DiskRows)
+	assert.Equal(t, int64(0), stats.CreatedRows)
+	assert.Equal(t, []int64{1, 2}, stats.AccessHistogram)
+}
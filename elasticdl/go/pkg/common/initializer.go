@@ -19,6 +19,8 @@ import (
 	"math"
 	"math/rand"
 	"reflect"
+	"strconv"
+	"strings"
 )
 
 // Initializer definition
@@ -57,6 +59,41 @@ var byteSetFuncs = map[DataType]func(buffer []byte, idx int, val interface{}){
 	Float64: byteSetFloat64,
 }
 
+// splitMix64 is a small rand.Source64 that is cheap to create for every tensor
+type splitMix64 struct {
+	state uint64
+}
+
+func mix64(z uint64) uint64 {
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	return mix64(s.state)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() >> 1)
+}
+
+// newRand creates a local random generator, so that initializers neither
+// depend on nor mutate the global math/rand state
+func newRand(seed int64) *rand.Rand {
+	return rand.New(&splitMix64{state: uint64(seed)})
+}
+
+// RowSeed derives the seed of an embedding row from the table seed and the row id
+func RowSeed(tableSeed int64, id int64) int64 {
+	return int64(mix64(uint64(tableSeed) ^ mix64(uint64(id))))
+}
+
 // Zero return a zero Initializer
 func Zero() Initializer {
 	return func(t *Tensor) error {
@@ -86,15 +123,15 @@ func Constant(n interface{}) Initializer {
 func RandomNorm(mean float64, std float64, seed int64) Initializer {
 	return func(t *Tensor) error {
 		length := int(DimProduct(t.Dims))
-		rand.Seed(seed)
+		rng := newRand(seed)
 		switch t.Dtype {
 		case Float32:
 			for i := 0; i < length; i++ {
-				byteSetFloat32(t.Buffer, i, float32(rand.NormFloat64()*std+mean))
+				byteSetFloat32(t.Buffer, i, float32(rng.NormFloat64()*std+mean))
 			}
 		case Float64:
 			for i := 0; i < length; i++ {
-				byteSetFloat64(t.Buffer, i, float64(rand.NormFloat64()*std+mean))
+				byteSetFloat64(t.Buffer, i, float64(rng.NormFloat64()*std+mean))
 			}
 		default:
 			return fmt.Errorf("Wrong tensor data type")
@@ -108,15 +145,15 @@ func RandomUniform(min float64, max float64, seed int64) Initializer {
 	return func(t *Tensor) error {
 		length := int(DimProduct(t.Dims))
 		factor := max - min
-		rand.Seed(seed)
+		rng := newRand(seed)
 		switch t.Dtype {
 		case Float32:
 			for i := 0; i < length; i++ {
-				byteSetFloat32(t.Buffer, i, rand.Float32()*float32(factor)+float32(min))
+				byteSetFloat32(t.Buffer, i, rng.Float32()*float32(factor)+float32(min))
 			}
 		case Float64:
 			for i := 0; i < length; i++ {
-				byteSetFloat64(t.Buffer, i, rand.Float64()*factor+min)
+				byteSetFloat64(t.Buffer, i, rng.Float64()*factor+min)
 			}
 		default:
 			return fmt.Errorf("Wrong tensor data type")
@@ -125,27 +162,27 @@ func RandomUniform(min float64, max float64, seed int64) Initializer {
 	}
 }
 
-func truncatedNorm(mean float64, std float64) float64 {
-	temp := rand.NormFloat64()*std + mean
+func truncatedNorm(rng *rand.Rand, mean float64, std float64) float64 {
+	temp := rng.NormFloat64()*std + mean
 	if math.Abs(temp-mean) <= 2*std {
 		return temp
 	}
-	return truncatedNorm(mean, std)
+	return truncatedNorm(rng, mean, std)
 }
 
 // TruncatedNormal return a truncated-normal Initializer
 func TruncatedNormal(mean float64, std float64, seed int64) Initializer {
 	return func(t *Tensor) error {
 		length := int(DimProduct(t.Dims))
-		rand.Seed(seed)
+		rng := newRand(seed)
 		switch t.Dtype {
 		case Float32:
 			for i := 0; i < length; i++ {
-				byteSetFloat32(t.Buffer, i, float32(truncatedNorm(mean, std)))
+				byteSetFloat32(t.Buffer, i, float32(truncatedNorm(rng, mean, std)))
 			}
 		case Float64:
 			for i := 0; i < length; i++ {
-				byteSetFloat64(t.Buffer, i, float64(truncatedNorm(mean, std)))
+				byteSetFloat64(t.Buffer, i, float64(truncatedNorm(rng, mean, std)))
 			}
 		default:
 			return fmt.Errorf("Wrong tensor data type")
@@ -153,3 +190,142 @@ func TruncatedNormal(mean float64, std float64, seed int64) Initializer {
 		return nil
 	}
 }
+
+// InitializerFactory creates an Initializer with a seed
+type InitializerFactory = func(seed int64) Initializer
+
+const (
+	initArgMinval = "minval"
+	initArgMaxval = "maxval"
+	initArgMean   = "mean"
+	initArgStddev = "stddev"
+	initArgValue  = "value"
+	initArgSeed   = "seed"
+
+	// truncatedNormalStddevFactor is the stddev of a unit normal truncated to [-2, 2],
+	// Keras divides the variance scaling stddev by it
+	truncatedNormalStddevFactor = 0.87962566103423978
+)
+
+// initArgumentsMap maps initializer names to their arguments and default values,
+// names follow Keras initializers
+var initArgumentsMap = map[string]map[string]float64{
+	"":                 {},
+	"zero":             {},
+	"zeros":            {},
+	"ones":             {},
+	"constant":         {initArgValue: 0},
+	"uniform":          {initArgMinval: -0.05, initArgMaxval: 0.05},
+	"random_uniform":   {initArgMinval: -0.05, initArgMaxval: 0.05},
+	"normal":           {initArgMean: 0, initArgStddev: 0.05},
+	"random_normal":    {initArgMean: 0, initArgStddev: 0.05},
+	"truncated_normal": {initArgMean: 0, initArgStddev: 0.05},
+	"glorot_uniform":   {},
+	"glorot_normal":    {},
+	"he_uniform":       {},
+	"he_normal":        {},
+}
+
+// initializerNames maps initializer names without underscores to their names in
+// initArgumentsMap, so that Keras class names such as "GlorotUniform" are accepted
+var initializerNames = func() map[string]string {
+	names := make(map[string]string)
+	for name := range initArgumentsMap {
+		names[strings.Replace(name, "_", "", -1)] = name
+	}
+	return names
+}()
+
+// ParseInitializer parses an initializer description for vectors of length dim.
+// A description is an initializer name optionally followed by arguments, e.g.
+// "random_uniform;minval=-0.1;maxval=0.1;seed=7". Names are case-insensitive and
+// may also be Keras class names, e.g. "RandomUniform". It returns the initializer
+// factory and the seed, which is 0 if not given.
+func ParseInitializer(desc string, dim int64) (InitializerFactory, int64, error) {
+	fields := strings.Split(desc, ";")
+	name, ok := initializerNames[strings.Replace(strings.ToLower(strings.TrimSpace(fields[0])), "_", "", -1)]
+	if !ok {
+		return nil, 0, fmt.Errorf("Unknown initializer %s", fields[0])
+	}
+	defaults := initArgumentsMap[name]
+	args := make(map[string]float64)
+	for k, v := range defaults {
+		args[k] = v
+	}
+	var tableSeed int64
+	for _, field := range fields[1:] {
+		if strings.TrimSpace(field) == "" {
+			continue
+		}
+		arr := strings.SplitN(field, "=", 2)
+		if len(arr) != 2 {
+			return nil, 0, fmt.Errorf("Wrong initializer argument %s", field)
+		}
+		key := strings.TrimSpace(arr[0])
+		value := strings.TrimSpace(arr[1])
+		if key == initArgSeed {
+			var err error
+			tableSeed, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("Having error converting initializer seed: %v", err)
+			}
+			continue
+		}
+		if _, ok := defaults[key]; !ok {
+			return nil, 0, fmt.Errorf("Initializer %s does not accept argument %s", name, key)
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Having error converting initializer argument %s: %v", key, err)
+		}
+		args[key] = number
+	}
+
+	// Fans of a vector are both its length, as for Keras initializers of 1-D shapes
+	fan := float64(dim)
+	switch name {
+	case "", "zero", "zeros":
+		return func(int64) Initializer { return Zero() }, tableSeed, nil
+	case "ones":
+		return func(int64) Initializer { return constantFloat(1) }, tableSeed, nil
+	case "constant":
+		value := args[initArgValue]
+		return func(int64) Initializer { return constantFloat(value) }, tableSeed, nil
+	case "uniform", "random_uniform":
+		min, max := args[initArgMinval], args[initArgMaxval]
+		return func(seed int64) Initializer { return RandomUniform(min, max, seed) }, tableSeed, nil
+	case "normal", "random_normal":
+		mean, stddev := args[initArgMean], args[initArgStddev]
+		return func(seed int64) Initializer { return RandomNorm(mean, stddev, seed) }, tableSeed, nil
+	case "truncated_normal":
+		mean, stddev := args[initArgMean], args[initArgStddev]
+		return func(seed int64) Initializer { return TruncatedNormal(mean, stddev, seed) }, tableSeed, nil
+	case "glorot_uniform":
+		limit := math.Sqrt(6 / (fan + fan))
+		return func(seed int64) Initializer { return RandomUniform(-limit, limit, seed) }, tableSeed, nil
+	case "glorot_normal":
+		stddev := math.Sqrt(2/(fan+fan)) / truncatedNormalStddevFactor
+		return func(seed int64) Initializer { return TruncatedNormal(0, stddev, seed) }, tableSeed, nil
+	case "he_uniform":
+		limit := math.Sqrt(6 / fan)
+		return func(seed int64) Initializer { return RandomUniform(-limit, limit, seed) }, tableSeed, nil
+	case "he_normal":
+		stddev := math.Sqrt(2/fan) / truncatedNormalStddevFactor
+		return func(seed int64) Initializer { return TruncatedNormal(0, stddev, seed) }, tableSeed, nil
+	}
+	return nil, 0, fmt.Errorf("Unknown initializer %s", name)
+}
+
+// constantFloat returns a constant Initializer for float tensors
+func constantFloat(value float64) Initializer {
+	return func(t *Tensor) error {
+		switch t.Dtype {
+		case Float32:
+			return Constant(float32(value))(t)
+		case Float64:
+			return Constant(value)(t)
+		default:
+			return fmt.Errorf("Wrong tensor data type")
+		}
+	}
+}
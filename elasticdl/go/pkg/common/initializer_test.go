@@ -15,7 +15,10 @@ package common
 
 import (
 	"fmt"
+	"math"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestInitializer(t *testing.T) {
@@ -41,3 +44,54 @@ func TestInitializer(t *testing.T) {
 	truncatenorminit(tensor)
 	fmt.Println(Slice(tensor).([]float32))
 }
+
+func TestParseInitializer(t *testing.T) {
+	tensor := NewEmptyVector(8, Float32)
+
+	initializerFn, seed, err := ParseInitializer("constant;value=0.5", 8)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), seed)
+	initializerFn(0)(tensor)
+	assert.Equal(t, []float32{0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5, 0.5}, Slice(tensor).([]float32))
+
+	initializerFn, seed, err = ParseInitializer("random_uniform;minval=1.0;maxval=2.0;seed=7", 8)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), seed)
+	initializerFn(seed)(tensor)
+	for _, v := range Slice(tensor).([]float32) {
+		assert.True(t, v >= 1.0 && v < 2.0)
+	}
+
+	initializerFn, _, err = ParseInitializer("glorot_uniform", 8)
+	assert.Nil(t, err)
+	initializerFn(1)(tensor)
+	limit := float32(math.Sqrt(6.0 / 16.0))
+	for _, v := range Slice(tensor).([]float32) {
+		assert.True(t, v >= -limit && v < limit)
+	}
+
+	for _, desc := range []string{"", "zeros", "ones", "normal", "truncated_normal", "glorot_normal", "he_uniform", "he_normal"} {
+		_, _, err = ParseInitializer(desc, 8)
+		assert.Nil(t, err, desc)
+	}
+
+	// Keras class names
+	for _, desc := range []string{"Zeros", "Ones", "Constant;value=2", "RandomUniform;minval=1.0;maxval=2.0",
+		"RandomNormal", "TruncatedNormal", "GlorotUniform", "GlorotNormal", "HeUniform", "HeNormal"} {
+		_, _, err = ParseInitializer(desc, 8)
+		assert.Nil(t, err, desc)
+	}
+	initializerFn, _, err = ParseInitializer("RandomUniform;minval=1.0;maxval=2.0", 8)
+	assert.Nil(t, err)
+	initializerFn(1)(tensor)
+	for _, v := range Slice(tensor).([]float32) {
+		assert.True(t, v >= 1.0 && v < 2.0)
+	}
+
+	_, _, err = ParseInitializer("orthogonal", 8)
+	assert.NotNil(t, err)
+	_, _, err = ParseInitializer("uniform;stddev=1.0", 8)
+	assert.NotNil(t, err)
+	_, _, err = ParseInitializer("uniform;minval", 8)
+	assert.NotNil(t, err)
+}
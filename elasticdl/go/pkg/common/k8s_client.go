@@ -14,11 +14,21 @@
 package common
 
 import (
+	"log/slog"
+	"time"
+
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"log"
+)
+
+const (
+	minWatchBackoff = time.Second
+	maxWatchBackoff = 30 * time.Second
 )
 
 // GetMasterPodName returns master pod name
@@ -26,27 +36,18 @@ func GetMasterPodName(jobName string) string {
 	return "elasticdl-" + jobName + "-master"
 }
 
-// CreateClientSet uses in-cluster config to create a clientset.
-func CreateClientSet() *kubernetes.Clientset {
+// CreateClientSet uses in-cluster config to create a clientset. It returns an
+// error if the process is not running in a Kubernetes cluster.
+func CreateClientSet() (*kubernetes.Clientset, error) {
 	config, err := rest.InClusterConfig()
 	if err != nil {
-		return nil
-	}
-	clientSet, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil
+		return nil, err
 	}
-	return clientSet
+	return kubernetes.NewForConfig(config)
 }
 
-// PodFinished returns true if the pod is Succeeded/Failed, or still running but with metadata.labels["status"]==""Finished"
-func PodFinished(clientSet *kubernetes.Clientset, namespace string, podName string) bool {
-	pod, err := clientSet.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
-	// Network instability may cause error, assuming not finished.
-	if err != nil {
-		log.Println("Get pod ", podName, " failed with err ", err)
-		return false
-	}
+// podFinished returns true if the pod is Succeeded/Failed, or still running but with metadata.labels["status"]==""Finished"
+func podFinished(pod *v1.Pod) bool {
 	if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
 		return true
 	} else if pod.Status.Phase == v1.PodRunning {
@@ -57,3 +58,94 @@ func PodFinished(clientSet *kubernetes.Clientset, namespace string, podName stri
 	}
 	return false
 }
+
+// PodFinished returns true if the pod is Succeeded/Failed, or still running but with metadata.labels["status"]==""Finished"
+func PodFinished(clientSet kubernetes.Interface, namespace string, podName string) bool {
+	pod, err := clientSet.CoreV1().Pods(namespace).Get(podName, metav1.GetOptions{})
+	// Network instability may cause error, assuming not finished.
+	if err != nil {
+		slog.Warn("Failed to get pod", "pod", podName, "error", err)
+		return false
+	}
+	return podFinished(pod)
+}
+
+// WatchPodFinished returns a channel which is closed once the pod is finished, see
+// PodFinished, or deleted. The pod is watched until stop is closed, and the watch
+// is restarted with an exponential backoff if it fails or ends.
+func WatchPodFinished(stop <-chan struct{}, clientSet kubernetes.Interface, namespace string,
+	podName string) <-chan struct{} {
+	finished := make(chan struct{})
+	go func() {
+		backoff := minWatchBackoff
+		for {
+			done, watched, err := watchPodOnce(stop, clientSet, namespace, podName)
+			if done {
+				close(finished)
+				return
+			}
+			if watched {
+				backoff = minWatchBackoff
+			}
+			if err != nil {
+				slog.Warn("Failed to watch pod", "pod", podName, "retry_in", backoff, "error", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxWatchBackoff {
+				backoff = maxWatchBackoff
+			}
+		}
+	}()
+	return finished
+}
+
+// watchPodOnce gets the pod and watches its changes until the watch ends. It
+// returns whether the pod is finished or deleted, and whether any event was received.
+func watchPodOnce(stop <-chan struct{}, clientSet kubernetes.Interface, namespace string,
+	podName string) (bool, bool, error) {
+	pods := clientSet.CoreV1().Pods(namespace)
+	pod, err := pods.Get(podName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if podFinished(pod) {
+		return true, false, nil
+	}
+	w, err := pods.Watch(metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", podName).String(),
+		ResourceVersion: pod.ResourceVersion,
+	})
+	if err != nil {
+		return false, false, err
+	}
+	defer w.Stop()
+	watched := false
+	for {
+		select {
+		case <-stop:
+			return false, watched, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return false, watched, nil
+			}
+			pod, isPod := event.Object.(*v1.Pod)
+			if !isPod || pod.Name != podName {
+				if event.Type == watch.Error {
+					return false, watched, errors.FromObject(event.Object)
+				}
+				continue
+			}
+			watched = true
+			if event.Type == watch.Deleted || podFinished(pod) {
+				return true, watched, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newPod(name string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Status:     v1.PodStatus{Phase: phase},
+	}
+}
+
+// waitClosed changes the pod until ch is closed, the fake clientset does not
+// replay changes made before the watch starts
+func waitClosed(t *testing.T, ch <-chan struct{}, change func()) {
+	for i := 0; i < 100; i++ {
+		change()
+		select {
+		case <-ch:
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("pod watch did not finish")
+}
+
+func TestPodFinished(t *testing.T) {
+	clientSet := fake.NewSimpleClientset(newPod("running", v1.PodRunning), newPod("failed", v1.PodFailed))
+	assert.False(t, PodFinished(clientSet, "default", "running"))
+	assert.True(t, PodFinished(clientSet, "default", "failed"))
+	assert.False(t, PodFinished(clientSet, "default", "missing"))
+	pod := newPod("labeled", v1.PodRunning)
+	pod.Labels = map[string]string{"status": "Finished"}
+	assert.True(t, podFinished(pod))
+}
+
+func TestWatchPodFinished(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	master := newPod("master", v1.PodRunning)
+	other := newPod("other", v1.PodRunning)
+	clientSet := fake.NewSimpleClientset(master, other)
+	pods := clientSet.CoreV1().Pods("default")
+
+	// a missing pod is finished
+	waitClosed(t, WatchPodFinished(stop, clientSet, "default", "missing"), func() {})
+
+	finished := WatchPodFinished(stop, clientSet, "default", "master")
+	other.Status.Phase = v1.PodSucceeded
+	_, err := pods.Update(other)
+	assert.Nil(t, err)
+	select {
+	case <-finished:
+		t.Fatal("the watch finished on another pod")
+	case <-time.After(50 * time.Millisecond):
+	}
+	master.Status.Phase = v1.PodSucceeded
+	waitClosed(t, finished, func() { pods.Update(master) })
+
+	master = newPod("master2", v1.PodRunning)
+	_, err = pods.Create(master)
+	assert.Nil(t, err)
+	finished = WatchPodFinished(stop, clientSet, "default", "master2")
+	waitClosed(t, finished, func() {
+		pods.Delete("master2", &metav1.DeleteOptions{})
+	})
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/types_go_proto"
+)
+
+// int8RowHeaderBytes is the size of the scale and the offset ahead of the codes of an int8 row
+const int8RowHeaderBytes = 8
+
+// float32ToHalf converts a float32 to IEEE 754 half precision, rounding to nearest even
+func float32ToHalf(f float32) uint16 {
+	b := math.Float32bits(f)
+	sign := uint16(b>>16) & 0x8000
+	exp := int32(b>>23&0xff) - 127 + 15
+	mant := b & 0x7fffff
+	if b&0x7fffffff > 0x7f800000 {
+		return sign | 0x7e00
+	}
+	if exp >= 0x1f {
+		return sign | 0x7c00
+	}
+	if exp <= 0 {
+		if exp < -10 {
+			return sign
+		}
+		mant |= 0x800000
+		shift := uint32(14 - exp)
+		half := mant >> shift
+		rem := mant & (1<<shift - 1)
+		mid := uint32(1) << (shift - 1)
+		if rem > mid || rem == mid && half&1 == 1 {
+			half++
+		}
+		return sign | uint16(half)
+	}
+	half := uint32(exp)<<10 | mant>>13
+	rem := mant & 0x1fff
+	if rem > 0x1000 || rem == 0x1000 && half&1 == 1 {
+		// a carry into the exponent is still the right encoding
+		half++
+	}
+	return sign | uint16(half)
+}
+
+// halfToFloat32 converts an IEEE 754 half precision number to float32
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+	switch exp {
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	case 0:
+		f := float32(mant) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	}
+	return math.Float32frombits(sign | (exp+112)<<23 | mant<<13)
+}
+
+// quantizeHalf stores a float32 row in half precision
+func quantizeHalf(src []byte, dst []byte) {
+	for i := 0; i*4 < len(src); i++ {
+		f := math.Float32frombits(binary.LittleEndian.Uint32(src[i*4:]))
+		binary.LittleEndian.PutUint16(dst[i*2:], float32ToHalf(f))
+	}
+}
+
+// dequantizeHalf restores a float32 row from half precision
+func dequantizeHalf(src []byte, dst []byte) {
+	for i := 0; i*4 < len(dst); i++ {
+		f := halfToFloat32(binary.LittleEndian.Uint16(src[i*2:]))
+		binary.LittleEndian.PutUint32(dst[i*4:], math.Float32bits(f))
+	}
+}
+
+// quantizeInt8 stores a float32 row as a float32 scale and offset followed by
+// int8 codes, where value = code * scale + offset
+func quantizeInt8(src []byte, dst []byte) {
+	n := len(src) / 4
+	values := make([]float32, n)
+	var min, max float32
+	for i := range values {
+		values[i] = math.Float32frombits(binary.LittleEndian.Uint32(src[i*4:]))
+		if i == 0 || values[i] < min {
+			min = values[i]
+		}
+		if i == 0 || values[i] > max {
+			max = values[i]
+		}
+	}
+	scale := (max - min) / 255
+	offset := min + 128*scale
+	binary.LittleEndian.PutUint32(dst, math.Float32bits(scale))
+	binary.LittleEndian.PutUint32(dst[4:], math.Float32bits(offset))
+	codes := dst[int8RowHeaderBytes:]
+	for i, v := range values {
+		code := 0.0
+		if scale > 0 {
+			code = math.Round(float64((v - offset) / scale))
+			code = math.Max(-128, math.Min(127, code))
+		}
+		codes[i] = byte(int8(code))
+	}
+}
+
+// dequantizeInt8 restores a float32 row from its int8 codes
+func dequantizeInt8(src []byte, dst []byte) {
+	scale := math.Float32frombits(binary.LittleEndian.Uint32(src))
+	offset := math.Float32frombits(binary.LittleEndian.Uint32(src[4:]))
+	codes := src[int8RowHeaderBytes:]
+	for i := 0; i*4 < len(dst); i++ {
+		f := float32(int8(codes[i]))*scale + offset
+		binary.LittleEndian.PutUint32(dst[i*4:], math.Float32bits(f))
+	}
+}
+
+// storageRowBytes returns the size of a row of dim values stored in a storage dtype
+func storageRowBytes(dim int64, storage types_go_proto.DataType) int64 {
+	if storage == Int8 {
+		return dim + int8RowHeaderBytes
+	}
+	return dim * int64(DtypeSize[storage])
+}
+
+// quantizeRow stores a float32 row in a storage dtype
+func quantizeRow(storage types_go_proto.DataType, src []byte, dst []byte) {
+	switch storage {
+	case Half:
+		quantizeHalf(src, dst)
+	case Int8:
+		quantizeInt8(src, dst)
+	default:
+		copy(dst, src)
+	}
+}
+
+// dequantizeRow restores a float32 row from a storage dtype
+func dequantizeRow(storage types_go_proto.DataType, src []byte, dst []byte) {
+	switch storage {
+	case Half:
+		dequantizeHalf(src, dst)
+	case Int8:
+		dequantizeInt8(src, dst)
+	default:
+		copy(dst, src)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/types_go_proto"
+)
+
+func TestHalf(t *testing.T) {
+	cases := map[float32]uint16{
+		0:            0x0000,
+		1:            0x3c00,
+		-2:           0xc000,
+		0.5:          0x3800,
+		65504:        0x7bff,
+		65520:        0x7c00,
+		1e-8:         0x0000,
+		5.9604645e-8: 0x0001,
+		1.0009766:    0x3c01,
+		1.0004883:    0x3c00,
+		1.0014648:    0x3c02,
+	}
+	for f, h := range cases {
+		assert.Equal(t, h, float32ToHalf(f), "float32ToHalf(%v)", f)
+	}
+	assert.Equal(t, uint16(0x7c00), float32ToHalf(float32(math.Inf(1))))
+	assert.True(t, math.IsNaN(float64(halfToFloat32(float32ToHalf(float32(math.NaN()))))))
+	for _, f := range []float32{0, 1, -2, 0.5, 65504, 5.9604645e-8, 1.0009766, -3.140625} {
+		assert.Equal(t, f, halfToFloat32(float32ToHalf(f)))
+	}
+}
+
+func TestQuantizeRow(t *testing.T) {
+	values := []float32{-1, -0.5, 0, 0.25, 1}
+	src := NewVector(values)
+	for _, storage := range []types_go_proto.DataType{Half, Int8} {
+		row := make([]byte, storageRowBytes(5, storage))
+		quantizeRow(storage, src.Buffer, row)
+		dst := NewEmptyVector(5, Float32)
+		dequantizeRow(storage, row, dst.Buffer)
+		assert.InDeltaSlice(t, values, Slice(dst).([]float32), 0.005, "%v", storage)
+	}
+
+	// a constant row has a zero scale
+	row := make([]byte, storageRowBytes(3, Int8))
+	quantizeRow(Int8, NewVector([]float32{2, 2, 2}).Buffer, row)
+	dst := NewEmptyVector(3, Float32)
+	dequantizeRow(Int8, row, dst.Buffer)
+	assert.Equal(t, []float32{2, 2, 2}, Slice(dst).([]float32))
+}
@@ -100,6 +100,19 @@ func DimProduct(dim []int64) int64 {
 	return size
 }
 
+// Clone returns a deep copy of the tensor
+func (t *Tensor) Clone() *Tensor {
+	buffer := make([]byte, len(t.Buffer))
+	copy(buffer, t.Buffer)
+	dims := make([]int64, len(t.Dims))
+	copy(dims, t.Dims)
+	return &Tensor{
+		Buffer: buffer,
+		Dims:   dims,
+		Dtype:  t.Dtype,
+	}
+}
+
 // GetSubTensor get the part reference of the tensor
 func (t *Tensor) GetSubTensor(begin int64, length int64) *Tensor {
 	dsize := int64(DtypeSize[t.Dtype])
@@ -199,10 +212,12 @@ func (t *Tensor) SerializeToTensorProto() *tensor_go_proto.TensorProto {
 	}
 }
 
-// IndexedSlices : IndexedSlices in-memory representation
+// IndexedSlices : IndexedSlices in-memory representation. Rows of a table with
+// string keys may have Keys instead of Ids.
 type IndexedSlices struct {
 	ConcatTensors *Tensor
 	Ids           []int64
+	Keys          []string
 }
 
 // NewIndexedSlices return a IndexedTensor instance
@@ -215,13 +230,22 @@ func NewIndexedSlices(t *Tensor, ids []int64) *IndexedSlices {
 
 // SerializeToIndexedSlicesProto return proto.IndexedSlices
 func (t *IndexedSlices) SerializeToIndexedSlicesProto() *proto.IndexedSlicesProto {
-	if t.ConcatTensors.Dims[0] != int64(len(t.Ids)) || len(t.ConcatTensors.Dims) != 2 {
+	if t.ConcatTensors.Dims[0] != int64(t.Len()) || len(t.ConcatTensors.Dims) != 2 {
 		return nil
 	}
 	return &proto.IndexedSlicesProto{
 		ConcatTensors: t.ConcatTensors.SerializeToTensorProto(),
 		Ids:           t.Ids,
+		Keys:          t.Keys,
+	}
+}
+
+// Len returns the number of rows, which have ids or keys
+func (t *IndexedSlices) Len() int {
+	if t.Keys != nil {
+		return len(t.Keys)
 	}
+	return len(t.Ids)
 }
 
 // DeserializeFromIndexedSliceProto return common.IndexedTensor
@@ -229,6 +253,7 @@ func DeserializeFromIndexedSliceProto(pb *proto.IndexedSlicesProto) *IndexedSlic
 	return &IndexedSlices{
 		ConcatTensors: DeserializeFromTensorProto(pb.ConcatTensors),
 		Ids:           pb.Ids,
+		Keys:          pb.Keys,
 	}
 }
 
@@ -251,14 +276,60 @@ func MergeIndexedSlices(first *IndexedSlices, second *IndexedSlices) (*IndexedSl
 	dtype := first.ConcatTensors.Dtype
 	tensor := NewEmptyTensor([]int64{height, width}, dtype)
 	var ids []int64
-	for i, id := range first.Ids {
+	var keys []string
+	for i := 0; i < first.Len(); i++ {
 		tensor.SetRow(int64(i), first.ConcatTensors.GetRow(int64(i)))
-		ids = append(ids, id)
 	}
-	start := len(ids)
-	for i, id := range second.Ids {
+	start := first.Len()
+	for i := 0; i < second.Len(); i++ {
 		tensor.SetRow(int64(start+i), second.ConcatTensors.GetRow(int64(i)))
-		ids = append(ids, id)
+	}
+	ids = append(append(ids, first.Ids...), second.Ids...)
+	if first.Keys != nil || second.Keys != nil {
+		keys = append(append(keys, first.Keys...), second.Keys...)
+	}
+	return &IndexedSlices{ConcatTensors: tensor, Ids: ids, Keys: keys}, nil
+}
+
+// DeduplicateIndexedSlices sums up the rows of duplicated ids, the ids keep the order of their first occurrence
+func DeduplicateIndexedSlices(slices *IndexedSlices) (*IndexedSlices, error) {
+	positions := make(map[int64]int, len(slices.Ids))
+	ids := make([]int64, 0, len(slices.Ids))
+	rowPositions := make([]int, len(slices.Ids))
+	for i, id := range slices.Ids {
+		p, ok := positions[id]
+		if !ok {
+			p = len(ids)
+			positions[id] = p
+			ids = append(ids, id)
+		}
+		rowPositions[i] = p
+	}
+	if len(ids) == len(slices.Ids) {
+		return slices, nil
+	}
+	width := int(slices.ConcatTensors.Dims[1])
+	dtype := slices.ConcatTensors.Dtype
+	tensor := NewEmptyTensor([]int64{int64(len(ids)), int64(width)}, dtype)
+	switch dtype {
+	case Float32:
+		src := Slice(slices.ConcatTensors).([]float32)
+		dst := Slice(tensor).([]float32)
+		for i, p := range rowPositions {
+			for j := 0; j < width; j++ {
+				dst[p*width+j] += src[i*width+j]
+			}
+		}
+	case Float64:
+		src := Slice(slices.ConcatTensors).([]float64)
+		dst := Slice(tensor).([]float64)
+		for i, p := range rowPositions {
+			for j := 0; j < width; j++ {
+				dst[p*width+j] += src[i*width+j]
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Could not deduplicate IndexedSlices of type %v", dtype)
 	}
 	return NewIndexedSlices(tensor, ids), nil
 }
@@ -82,3 +82,18 @@ func TestPbTransform(t *testing.T) {
 	pb2 := t1.SerializeToTensorProto()
 	assert.Equal(t, pb2.GetTensorContent(), bval, "Serialize FAIL")
 }
+
+func TestDeduplicateIndexedSlices(t *testing.T) {
+	v := []float32{1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0}
+	slices := NewIndexedSlices(NewTensor(v, []int64{4, 2}), []int64{3, 1, 3, 3})
+	deduplicated, err := DeduplicateIndexedSlices(slices)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{3, 1}, deduplicated.Ids)
+	assert.Equal(t, []int64{2, 2}, deduplicated.ConcatTensors.Dims)
+	assert.Equal(t, []float32{13.0, 16.0, 3.0, 4.0}, Slice(deduplicated.ConcatTensors).([]float32))
+
+	unique := NewIndexedSlices(NewTensor(v[:4], []int64{2, 2}), []int64{1, 2})
+	deduplicated, err = DeduplicateIndexedSlices(unique)
+	assert.Nil(t, err)
+	assert.Equal(t, unique, deduplicated)
+}
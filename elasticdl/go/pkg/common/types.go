@@ -29,6 +29,7 @@ const (
 	Int32   = types_go_proto.DataType_DT_INT32
 	Int64   = types_go_proto.DataType_DT_INT64
 	Float16 = types_go_proto.DataType_DT_BFLOAT16
+	Half    = types_go_proto.DataType_DT_HALF
 	Float32 = types_go_proto.DataType_DT_FLOAT
 	Float64 = types_go_proto.DataType_DT_DOUBLE
 	Bool    = types_go_proto.DataType_DT_BOOL
@@ -53,6 +54,7 @@ func init() {
 	DtypeSize[types_go_proto.DataType_DT_INT32] = 4
 	DtypeSize[types_go_proto.DataType_DT_INT64] = 8
 	DtypeSize[types_go_proto.DataType_DT_BFLOAT16] = 2
+	DtypeSize[types_go_proto.DataType_DT_HALF] = 2
 	DtypeSize[types_go_proto.DataType_DT_FLOAT] = 4
 	DtypeSize[types_go_proto.DataType_DT_DOUBLE] = 8
 	DtypeSize[types_go_proto.DataType_DT_BOOL] = 1
@@ -93,4 +93,72 @@ void Adagrad(float* grad,
 
   em += eg.square();
   ep -= lr * eg / (em.sqrt() + epsilon);
-}
\ No newline at end of file
+}
+
+// The Sparse* kernels below update `num` rows in one call. `grad` holds the
+// gradient rows contiguously, and the i-th gradient row is applied to the rows
+// pointed to by param[i] (and the slot rows at the same position). Rows are
+// updated in order, so duplicated rows accumulate the same way as calling the
+// dense kernel once per row.
+
+void SparseSGD(float* grad,
+               float** param,
+               float lr,
+               long long num,
+               long long dim) {
+  for (long long i = 0; i < num; ++i) {
+    SGD(grad + i * dim, param[i], lr, dim);
+  }
+}
+
+void SparseMomentum(float* grad,
+                    float** param,
+                    float** velocity,
+                    float mu,
+                    bool nesterov,
+                    float lr,
+                    long long num,
+                    long long dim) {
+  for (long long i = 0; i < num; ++i) {
+    Momentum(grad + i * dim, param[i], velocity[i], mu, nesterov, lr, dim);
+  }
+}
+
+void SparseAdam(float* grad,
+                float** param,
+                float** m,
+                float** v,
+                float lr,
+                long long num,
+                long long dim,
+                long long step,
+                float beta1,
+                float beta2,
+                float epsilon,
+                float** max_square) {
+  for (long long i = 0; i < num; ++i) {
+    Adam(grad + i * dim,
+         param[i],
+         m[i],
+         v[i],
+         lr,
+         dim,
+         step,
+         beta1,
+         beta2,
+         epsilon,
+         max_square != NULL ? max_square[i] : NULL);
+  }
+}
+
+void SparseAdagrad(float* grad,
+                   float** param,
+                   float** m,
+                   float lr,
+                   long long num,
+                   long long dim,
+                   float epsilon) {
+  for (long long i = 0; i < num; ++i) {
+    Adagrad(grad + i * dim, param[i], m[i], lr, dim, epsilon);
+  }
+}
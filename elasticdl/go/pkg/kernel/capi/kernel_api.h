@@ -36,6 +36,42 @@ void Adagrad(float* grad,
              long long size,
              float epsilon);
 
+void SparseSGD(float* grad,
+               float** param,
+               float lr,
+               long long num,
+               long long dim);
+
+void SparseMomentum(float* grad,
+                    float** param,
+                    float** velocity,
+                    float mu,
+                    bool nesterov,
+                    float lr,
+                    long long num,
+                    long long dim);
+
+void SparseAdam(float* grad,
+                float** param,
+                float** m,
+                float** v,
+                float lr,
+                long long num,
+                long long dim,
+                long long step,
+                float beta1,
+                float beta2,
+                float epsilon,
+                float** max_square);
+
+void SparseAdagrad(float* grad,
+                   float** param,
+                   float** m,
+                   float lr,
+                   long long num,
+                   long long dim,
+                   float epsilon);
+
 #ifdef __cplusplus
 }
 #endif
@@ -18,11 +18,55 @@ package kernel
 import "C"
 import (
 	"fmt"
+	"runtime"
 	"unsafe"
 
 	"elasticdl.org/elasticdl/pkg/common"
 )
 
+// rowPtrs holds the addresses of embedding rows for the batched C kernels. The
+// addresses are stored as uintptr so the array itself contains no Go pointers
+// and can be handed to C; callers keep the rows reachable until the call returns.
+type rowPtrs []uintptr
+
+// embeddingRows are the rows of ids in an embedding table for the batched C kernels.
+// The rows of a quantized table are dequantized copies, put writes them back once
+// they are updated.
+type embeddingRows struct {
+	table   *common.EmbeddingTable
+	ids     []int64
+	vectors []*common.Tensor
+	ptrs    rowPtrs
+}
+
+func tableRows(table *common.EmbeddingTable, ids []int64) *embeddingRows {
+	vectors := table.GetEmbeddingVectorRefs(ids)
+	ptrs := make(rowPtrs, len(vectors))
+	for i, vector := range vectors {
+		ptrs[i] = uintptr(unsafe.Pointer(&vector.Buffer[0]))
+	}
+	return &embeddingRows{table, ids, vectors, ptrs}
+}
+
+func (r *embeddingRows) put() {
+	r.table.PutEmbeddingVectorRefs(r.ids, r.vectors)
+}
+
+func tensorRows(t *common.Tensor, ids []int64) rowPtrs {
+	ptrs := make(rowPtrs, len(ids))
+	for i, id := range ids {
+		ptrs[i] = uintptr(unsafe.Pointer(&t.GetRow(id).Buffer[0]))
+	}
+	return ptrs
+}
+
+func (p rowPtrs) cptr() **C.float {
+	if p == nil {
+		return nil
+	}
+	return (**C.float)(unsafe.Pointer(&p[0]))
+}
+
 // SGD kernel
 func SGD(grad *common.Tensor, param *common.Tensor, lr float32) {
 	gradPtr := (*C.float)(unsafe.Pointer(&grad.Buffer[0]))
@@ -36,24 +80,31 @@ func SparseSGD(grad *common.IndexedSlices, param *common.EmbeddingTable, lr floa
 	if grad.ConcatTensors.Dims[1] != param.Dim {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		vector := param.GetEmbeddingVector(index)
-		subGrad := grad.ConcatTensors.GetRow(int64(i))
-		SGD(subGrad, vector, lr)
+	if len(grad.Ids) == 0 {
+		return nil
 	}
+	rows := tableRows(param, grad.Ids)
+	batchSGD(grad, rows.ptrs, lr)
+	rows.put()
 	return nil
 }
 
 // IndexedSGD kernel
 func IndexedSGD(grad *common.IndexedSlices, param *common.Tensor, lr float32) error {
-	for i, index := range grad.Ids {
-		vector := param.GetRow(index)
-		subGrad := grad.ConcatTensors.GetRow(int64(i))
-		SGD(subGrad, vector, lr)
+	if len(grad.Ids) == 0 {
+		return nil
 	}
+	batchSGD(grad, tensorRows(param, grad.Ids), lr)
+	runtime.KeepAlive(param)
 	return nil
 }
 
+func batchSGD(grad *common.IndexedSlices, param rowPtrs, lr float32) {
+	gradPtr := (*C.float)(unsafe.Pointer(&grad.ConcatTensors.Buffer[0]))
+	C.SparseSGD(gradPtr, param.cptr(), C.float(lr), C.longlong(len(grad.Ids)),
+		C.longlong(grad.ConcatTensors.Dims[1]))
+}
+
 // Momentum kernel
 func Momentum(grad *common.Tensor, param *common.Tensor, velocity *common.Tensor,
 	mu float32, nesterov bool, lr float32) {
@@ -71,12 +122,13 @@ func SparseMomentum(grad *common.IndexedSlices, param *common.EmbeddingTable,
 	if grad.ConcatTensors.Dims[1] != param.Dim {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		vector := param.GetEmbeddingVector(index)
-		subGrad := grad.ConcatTensors.GetRow(int64(i))
-		subVelocity := velocity.GetEmbeddingVector(index)
-		Momentum(subGrad, vector, subVelocity, mu, nesterov, lr)
+	if len(grad.Ids) == 0 {
+		return nil
 	}
+	rows, velocityRows := tableRows(param, grad.Ids), tableRows(velocity, grad.Ids)
+	batchMomentum(grad, rows.ptrs, velocityRows.ptrs, mu, nesterov, lr)
+	rows.put()
+	velocityRows.put()
 	return nil
 }
 
@@ -86,15 +138,23 @@ func IndexedMomentum(grad *common.IndexedSlices, param *common.Tensor, velocity
 	if grad.ConcatTensors.Dims[1] != param.Dims[1] {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		vector := param.GetRow(index)
-		subGrad := grad.ConcatTensors.GetRow(int64(i))
-		subVelocity := velocity.GetRow(index)
-		Momentum(subGrad, vector, subVelocity, mu, nesterov, lr)
+	if len(grad.Ids) == 0 {
+		return nil
 	}
+	batchMomentum(grad, tensorRows(param, grad.Ids), tensorRows(velocity, grad.Ids),
+		mu, nesterov, lr)
+	runtime.KeepAlive(param)
+	runtime.KeepAlive(velocity)
 	return nil
 }
 
+func batchMomentum(grad *common.IndexedSlices, param rowPtrs, velocity rowPtrs,
+	mu float32, nesterov bool, lr float32) {
+	gradPtr := (*C.float)(unsafe.Pointer(&grad.ConcatTensors.Buffer[0]))
+	C.SparseMomentum(gradPtr, param.cptr(), velocity.cptr(), C.float(mu), C._Bool(nesterov),
+		C.float(lr), C.longlong(len(grad.Ids)), C.longlong(grad.ConcatTensors.Dims[1]))
+}
+
 // Adam kernel
 func Adam(grad *common.Tensor, param *common.Tensor, m *common.Tensor, v *common.Tensor,
 	lr float32, step int64, beta1 float32, beta2 float32,
@@ -123,16 +183,22 @@ func SparseAdam(grad *common.IndexedSlices, param *common.EmbeddingTable,
 	if grad.ConcatTensors.Dims[1] != param.Dim {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		subgrad := grad.ConcatTensors.GetRow(int64(i))
-		subparam := param.GetEmbeddingVector(index)
-		subm := m.GetEmbeddingVector(index)
-		subv := v.GetEmbeddingVector(index)
-		var submaxs *common.Tensor = nil
-		if amsgrad {
-			submaxs = maxSquare.GetEmbeddingVector(index)
-		}
-		Adam(subgrad, subparam, subm, subv, lr, step, beta1, beta2, epsilon, amsgrad, submaxs)
+	if len(grad.Ids) == 0 {
+		return nil
+	}
+	var maxSquarePtrs rowPtrs
+	var maxSquareRows *embeddingRows
+	if amsgrad {
+		maxSquareRows = tableRows(maxSquare, grad.Ids)
+		maxSquarePtrs = maxSquareRows.ptrs
+	}
+	rows, mRows, vRows := tableRows(param, grad.Ids), tableRows(m, grad.Ids), tableRows(v, grad.Ids)
+	batchAdam(grad, rows.ptrs, mRows.ptrs, vRows.ptrs, lr, step, beta1, beta2, epsilon, maxSquarePtrs)
+	rows.put()
+	mRows.put()
+	vRows.put()
+	if amsgrad {
+		maxSquareRows.put()
 	}
 	return nil
 }
@@ -145,20 +211,32 @@ func IndexedAdam(grad *common.IndexedSlices, param *common.Tensor,
 	if grad.ConcatTensors.Dims[1] != param.Dims[1] {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		subgrad := grad.ConcatTensors.GetRow(int64(i))
-		subparam := param.GetRow(index)
-		subm := m.GetRow(index)
-		subv := v.GetRow(index)
-		var submaxs *common.Tensor = nil
-		if amsgrad {
-			submaxs = maxSquare.GetRow(index)
-		}
-		Adam(subgrad, subparam, subm, subv, lr, step, beta1, beta2, epsilon, amsgrad, submaxs)
+	if len(grad.Ids) == 0 {
+		return nil
+	}
+	var maxSquareRows rowPtrs
+	if amsgrad {
+		maxSquareRows = tensorRows(maxSquare, grad.Ids)
 	}
+	batchAdam(grad, tensorRows(param, grad.Ids), tensorRows(m, grad.Ids), tensorRows(v, grad.Ids),
+		lr, step, beta1, beta2, epsilon, maxSquareRows)
+	runtime.KeepAlive(param)
+	runtime.KeepAlive(m)
+	runtime.KeepAlive(v)
+	runtime.KeepAlive(maxSquare)
 	return nil
 }
 
+func batchAdam(grad *common.IndexedSlices, param rowPtrs, m rowPtrs, v rowPtrs,
+	lr float32, step int64, beta1 float32, beta2 float32, epsilon float32,
+	maxSquare rowPtrs) {
+	gradPtr := (*C.float)(unsafe.Pointer(&grad.ConcatTensors.Buffer[0]))
+	C.SparseAdam(gradPtr, param.cptr(), m.cptr(), v.cptr(), C.float(lr),
+		C.longlong(len(grad.Ids)), C.longlong(grad.ConcatTensors.Dims[1]),
+		C.longlong(step), C.float(beta1), C.float(beta2), C.float(epsilon),
+		maxSquare.cptr())
+}
+
 // Adagrad kernel
 func Adagrad(grad *common.Tensor, param *common.Tensor, m *common.Tensor, lr float32, epsilon float32) {
 	gradPtr := (*C.float)(unsafe.Pointer(&grad.Buffer[0]))
@@ -174,12 +252,13 @@ func SparseAdagrad(grad *common.IndexedSlices, param *common.EmbeddingTable,
 	if grad.ConcatTensors.Dims[1] != param.Dim {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		subgrad := grad.ConcatTensors.GetRow(int64(i))
-		subparam := param.GetEmbeddingVector(index)
-		subm := m.GetEmbeddingVector(index)
-		Adagrad(subgrad, subparam, subm, lr, epsilon)
+	if len(grad.Ids) == 0 {
+		return nil
 	}
+	rows, mRows := tableRows(param, grad.Ids), tableRows(m, grad.Ids)
+	batchAdagrad(grad, rows.ptrs, mRows.ptrs, lr, epsilon)
+	rows.put()
+	mRows.put()
 	return nil
 }
 
@@ -189,11 +268,17 @@ func IndexedAdagrad(grad *common.IndexedSlices, param *common.Tensor,
 	if grad.ConcatTensors.Dims[1] != param.Dims[1] {
 		return fmt.Errorf("grad width is not equal to embedding dim")
 	}
-	for i, index := range grad.Ids {
-		subgrad := grad.ConcatTensors.GetRow(int64(i))
-		subparam := param.GetRow(index)
-		subm := m.GetRow(index)
-		Adagrad(subgrad, subparam, subm, lr, epsilon)
+	if len(grad.Ids) == 0 {
+		return nil
 	}
+	batchAdagrad(grad, tensorRows(param, grad.Ids), tensorRows(m, grad.Ids), lr, epsilon)
+	runtime.KeepAlive(param)
+	runtime.KeepAlive(m)
 	return nil
 }
+
+func batchAdagrad(grad *common.IndexedSlices, param rowPtrs, m rowPtrs, lr float32, epsilon float32) {
+	gradPtr := (*C.float)(unsafe.Pointer(&grad.ConcatTensors.Buffer[0]))
+	C.SparseAdagrad(gradPtr, param.cptr(), m.cptr(), C.float(lr), C.longlong(len(grad.Ids)),
+		C.longlong(grad.ConcatTensors.Dims[1]), C.float(epsilon))
+}
@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"elasticdl.org/elasticdl/pkg/common"
+	"elasticdl.org/elasticdl/pkg/proto"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -53,11 +54,12 @@ func TestSparseSGD(t *testing.T) {
 	grad := common.NewTensor(a, d)
 	isgrad := common.NewIndexedSlices(grad, indices)
 
-	table := common.NewEmbeddingTable(2, "zero", common.Float32)
+	table, err := common.NewEmbeddingTable(2, "zero", common.Float32)
+	assert.Nil(t, err)
 
-	err := SparseSGD(isgrad, table, 0.1)
+	err = SparseSGD(isgrad, table, 0.1)
 	assert.Nil(t, err)
-	assert.Equal(t, 2, len(table.EmbeddingVectors))
+	assert.Equal(t, 2, table.Len())
 
 	v1 := table.GetEmbeddingVector(1)
 	assert.Equal(t, []float32{0.1, 0.1}, common.Slice(v1).([]float32))
@@ -66,6 +68,21 @@ func TestSparseSGD(t *testing.T) {
 	assert.Equal(t, []float32{0.2, 0.2}, common.Slice(v3).([]float32))
 }
 
+func TestSparseSGDQuantized(t *testing.T) {
+	grad := common.NewTensor([]float32{-1.0, -1.0, -1.0, -1.0, -1.0, -1.0}, []int64{3, 2})
+	isgrad := common.NewIndexedSlices(grad, []int64{1, 3, 3})
+	info := &proto.EmbeddingTableInfo{Name: "e", Dim: 2, Initializer: "zero",
+		Dtype: common.Float32, StorageDtype: common.Half}
+	table, _ := common.NewEmbeddingTableFromInfo(info)
+
+	err := SparseSGD(isgrad, table, 0.1)
+	assert.Nil(t, err)
+	v1 := table.GetEmbeddingVector(1)
+	assert.InDeltaSlice(t, []float32{0.1, 0.1}, common.Slice(v1).([]float32), 0.001)
+	v3 := table.GetEmbeddingVector(3)
+	assert.InDeltaSlice(t, []float32{0.2, 0.2}, common.Slice(v3).([]float32), 0.001)
+}
+
 func TestAdam(t *testing.T) {
 	const size int = 10
 	rawGrad := make([]float32, size)
@@ -189,10 +206,14 @@ func TestSparseAdam(t *testing.T) {
 	dim := []int64{1, 10}
 
 	var embdim int64 = 10
-	ptable := common.NewEmbeddingTable(embdim, "zero", common.Float32)
-	mtable := common.NewEmbeddingTable(embdim, "zero", common.Float32)
-	vtable := common.NewEmbeddingTable(embdim, "zero", common.Float32)
-	mstable := common.NewEmbeddingTable(embdim, "zero", common.Float32)
+	ptable, err := common.NewEmbeddingTable(embdim, "zero", common.Float32)
+	assert.Nil(t, err)
+	mtable, err := common.NewEmbeddingTable(embdim, "zero", common.Float32)
+	assert.Nil(t, err)
+	vtable, err := common.NewEmbeddingTable(embdim, "zero", common.Float32)
+	assert.Nil(t, err)
+	mstable, err := common.NewEmbeddingTable(embdim, "zero", common.Float32)
+	assert.Nil(t, err)
 
 	for i := 0; i < size; i++ {
 		rawGrad[i] = rand.Float32()
@@ -209,10 +230,10 @@ func TestSparseAdam(t *testing.T) {
 	maxSquare := common.NewTensor(rawMaxSquare, dim)
 	isgrad := common.NewIndexedSlices(grad, []int64{1})
 
-	ptable.EmbeddingVectors[1] = param
-	mtable.EmbeddingVectors[1] = m
-	vtable.EmbeddingVectors[1] = v
-	mstable.EmbeddingVectors[1] = maxSquare
+	ptable.SetEmbeddingVectors(common.NewIndexedSlices(param, []int64{1}))
+	mtable.SetEmbeddingVectors(common.NewIndexedSlices(m, []int64{1}))
+	vtable.SetEmbeddingVectors(common.NewIndexedSlices(v, []int64{1}))
+	mstable.SetEmbeddingVectors(common.NewIndexedSlices(maxSquare, []int64{1}))
 
 	var lr float32 = 0.1
 	var step int64 = 5
@@ -246,9 +267,68 @@ func TestSparseAdam(t *testing.T) {
 
 	SparseAdam(isgrad, ptable, mtable, vtable, lr, step, beta1, beta2,
 		epsilon, true, mstable)
+	param = ptable.GetEmbeddingVector(1)
+	m = mtable.GetEmbeddingVector(1)
+	v = vtable.GetEmbeddingVector(1)
+	maxSquare = mstable.GetEmbeddingVector(1)
 
 	assert.True(t, common.CompareFloatArray(expectedM, common.Slice(m).([]float32), 0.00001))
 	assert.True(t, common.CompareFloatArray(expectedV, common.Slice(v).([]float32), 0.00001))
 	assert.True(t, common.CompareFloatArray(expectedParam, common.Slice(param).([]float32), 0.00001))
 	assert.True(t, common.CompareFloatArray(expectedMaxSquare, common.Slice(maxSquare).([]float32), 0.00001))
 }
+
+func TestSparseMomentum(t *testing.T) {
+	const height int = 4
+	const width int = 8
+	rawGrad := make([]float32, height*width)
+	for i := range rawGrad {
+		rawGrad[i] = rand.Float32()
+	}
+	ids := []int64{2, 7, 2, 5}
+	grad := common.NewIndexedSlices(common.NewTensor(rawGrad, []int64{int64(height), int64(width)}), ids)
+
+	ptable, err := common.NewEmbeddingTable(int64(width), "zero", common.Float32)
+	assert.Nil(t, err)
+	vtable, err := common.NewEmbeddingTable(int64(width), "zero", common.Float32)
+	assert.Nil(t, err)
+	expectedParam := make(map[int64]*common.Tensor)
+	expectedVelocity := make(map[int64]*common.Tensor)
+	for _, id := range ids {
+		expectedParam[id] = common.NewEmptyVector(int64(width), common.Float32)
+		expectedVelocity[id] = common.NewEmptyVector(int64(width), common.Float32)
+	}
+
+	var lr float32 = 0.1
+	var mu float32 = 0.9
+	for i, id := range ids {
+		Momentum(grad.ConcatTensors.GetRow(int64(i)), expectedParam[id], expectedVelocity[id], mu, true, lr)
+	}
+
+	err = SparseMomentum(grad, ptable, vtable, mu, true, lr)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, ptable.Len())
+	for id, expected := range expectedParam {
+		assert.True(t, common.CompareFloatArray(common.Slice(expected).([]float32),
+			common.Slice(ptable.GetEmbeddingVector(id)).([]float32), 0.00001))
+		assert.True(t, common.CompareFloatArray(common.Slice(expectedVelocity[id]).([]float32),
+			common.Slice(vtable.GetEmbeddingVector(id)).([]float32), 0.00001))
+	}
+}
+
+func TestIndexedAdagrad(t *testing.T) {
+	rawGrad := []float32{1.0, 2.0, 3.0, 4.0}
+	rawParam := []float32{1.0, 1.0, 1.0, 1.0, 1.0, 1.0}
+	rawM := []float32{0.0, 0.0, 0.0, 0.0, 0.0, 0.0}
+	grad := common.NewIndexedSlices(common.NewTensor(rawGrad, []int64{2, 2}), []int64{2, 0})
+	param := common.NewTensor(rawParam, []int64{3, 2})
+	m := common.NewTensor(rawM, []int64{3, 2})
+
+	var lr float32 = 0.1
+	var epsilon float32 = 1e-8
+	err := IndexedAdagrad(grad, param, m, lr, epsilon)
+	assert.Nil(t, err)
+
+	assert.True(t, common.CompareFloatArray([]float32{9.0, 16.0, 0.0, 0.0, 1.0, 4.0}, rawM, 0.00001))
+	assert.True(t, common.CompareFloatArray([]float32{0.9, 0.9, 1.0, 1.0, 0.9, 0.9}, rawParam, 0.00001))
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevel(t *testing.T) {
+	for name, expected := range map[string]slog.Level{
+		"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		level, err := ParseLevel(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, level)
+	}
+	_, err := ParseLevel("verbose")
+	assert.NotNil(t, err)
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, slog.LevelInfo).With("ps_id", 1)
+	assert.Equal(t, slog.Default(), FromContext(context.Background()))
+	ctx := NewContext(context.Background(), logger)
+	FromContext(ctx).Debug("dropped")
+	FromContext(ctx).Warn("Failed to report model version", "model_version", 10)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 1, len(lines))
+	var record map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "Failed to report model version", record["msg"])
+	assert.Equal(t, float64(1), record["ps_id"])
+	assert.Equal(t, float64(10), record["model_version"])
+}
@@ -53,9 +53,23 @@ func loadPBFromFile(file string) (*proto.Model, error) {
 	return res, nil
 }
 
-func savePBToFile(pb *proto.Model, file string) {
-	b, _ := go_pb.Marshal(pb)
-	ioutil.WriteFile(file, b, os.ModePerm)
+// savePBToFile writes a temporary file and renames it to file, so that an
+// interrupted save does not leave a truncated checkpoint file. It returns the
+// size of the file.
+func savePBToFile(pb *proto.Model, file string) (int, error) {
+	b, err := go_pb.Marshal(pb)
+	if err != nil {
+		return 0, err
+	}
+	tmp := file + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, os.ModePerm); err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return len(b), nil
 }
 
 func loadModelShardFromPB(pb *proto.Model, shardID int, shardNum int) (map[string]*common.Tensor,
@@ -71,7 +85,29 @@ func loadModelShardFromPB(pb *proto.Model, shardID int, shardNum int) (map[strin
 
 	for name, v := range pb.EmbeddingTables {
 		indexedSlices := common.DeserializeFromIndexedSliceProto(v)
-		if indexedSlices != nil {
+		if indexedSlices != nil && indexedSlices.Keys != nil {
+			// rows of tables with string keys are sharded by their keys and keep their ids
+			var keys []string
+			var ids []int64
+			var rows []int64
+			withIDs := len(indexedSlices.Ids) == len(indexedSlices.Keys)
+			for i, key := range indexedSlices.Keys {
+				if StringToID(key, shardNum) == shardID {
+					keys = append(keys, key)
+					rows = append(rows, int64(i))
+					if withIDs {
+						ids = append(ids, indexedSlices.Ids[i])
+					}
+				}
+			}
+			width := indexedSlices.ConcatTensors.Dims[1]
+			dtype := indexedSlices.ConcatTensors.Dtype
+			tensor := common.NewEmptyTensor([]int64{int64(len(keys)), width}, dtype)
+			for i, row := range rows {
+				tensor.SetRow(int64(i), indexedSlices.ConcatTensors.GetRow(row))
+			}
+			embeddingParams[name] = &common.IndexedSlices{ConcatTensors: tensor, Ids: ids, Keys: keys}
+		} else if indexedSlices != nil {
 			var ids []int64
 			idsMap := make(map[int64]int64)
 			for i, id := range indexedSlices.Ids {
@@ -96,21 +132,34 @@ func loadModelShardFromPB(pb *proto.Model, shardID int, shardNum int) (map[strin
 
 // LoadModelFromCheckpoint loads model from checkpoint directory
 func LoadModelFromCheckpoint(checkpointDir string, shardID int, shardNum int) (*Model, error) {
+	model := NewModel()
+	if err := loadCheckpoint(model, checkpointDir, shardID, shardNum); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// loadCheckpoint loads parameters from checkpoint directory into an empty model
+func loadCheckpoint(model *Model, checkpointDir string, shardID int, shardNum int) error {
 	files, err1 := ioutil.ReadDir(checkpointDir)
 	if err1 != nil {
-		return nil, err1
+		return err1
 	}
 
-	model := NewModel()
 	embeddingParams := make(map[string]*common.IndexedSlices)
 	for _, file := range files {
+		if path.Ext(file.Name()) != ".ckpt" {
+			continue
+		}
 		pb, err2 := loadPBFromFile(path.Join(checkpointDir, file.Name()))
 		if err2 != nil {
-			return nil, err2
+			return err2
 		}
 
 		for _, info := range pb.EmbeddingTableInfos {
-			model.SetEmbeddingTableInfo(info)
+			if err := model.SetEmbeddingTableInfo(info); err != nil {
+				return err
+			}
 		}
 
 		dp, ep := loadModelShardFromPB(pb, shardID, shardNum)
@@ -121,7 +170,7 @@ func LoadModelFromCheckpoint(checkpointDir string, shardID int, shardNum int) (*
 			var err3 error
 			embeddingParams[k], err3 = common.MergeIndexedSlices(embeddingParams[k], v)
 			if err3 != nil {
-				return nil, err3
+				return err3
 			}
 		}
 	}
@@ -129,13 +178,25 @@ func LoadModelFromCheckpoint(checkpointDir string, shardID int, shardNum int) (*
 	for k, v := range embeddingParams {
 		model.EmbeddingTables[k].SetEmbeddingVectors(v)
 	}
-	return model, nil
+	for _, table := range model.EmbeddingTables {
+		table.ResetCreatedRows()
+	}
+	return nil
 }
 
-// SaveModelToCheckpoint saves in-memory model to checkpoint
-func SaveModelToCheckpoint(checkpointDir string, model *Model, shardID int, shardNum int) {
-	os.MkdirAll(checkpointDir, os.ModePerm)
+// SaveModelToCheckpoint saves in-memory model to checkpoint and returns the size of the checkpoint file
+func SaveModelToCheckpoint(checkpointDir string, model *Model, shardID int, shardNum int) (int, error) {
+	if err := os.MkdirAll(checkpointDir, os.ModePerm); err != nil {
+		return 0, err
+	}
 	file := fmt.Sprintf("variables-%d-of-%d.ckpt", shardID, shardNum)
 	modelPB := model.SaveToModelPB()
-	savePBToFile(modelPB, path.Join(checkpointDir, file))
+	size, err := savePBToFile(modelPB, path.Join(checkpointDir, file))
+	if err != nil {
+		return 0, err
+	}
+	for _, table := range model.EmbeddingTables {
+		table.ResetCreatedRows()
+	}
+	return size, nil
 }
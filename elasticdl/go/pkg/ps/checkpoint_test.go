@@ -14,11 +14,13 @@
 package ps
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
 
 	"elasticdl.org/elasticdl/pkg/common"
+	"elasticdl.org/elasticdl/pkg/proto"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,7 +36,7 @@ func TestCheckpoint(t *testing.T) {
 	i1 := []int64{0, 2, 4}
 	is1 := common.NewIndexedSlices(t1, i1)
 
-	model1.EmbeddingTables["e1"] = common.NewEmbeddingTable(2, "zero", common.Float32)
+	assert.Nil(t, model1.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}))
 	model1.EmbeddingTables["e1"].SetEmbeddingVectors(is1)
 
 	model2 := NewModel()
@@ -44,11 +46,18 @@ func TestCheckpoint(t *testing.T) {
 	i2 := []int64{1, 3, 5}
 	is2 := common.NewIndexedSlices(t2, i2)
 
-	model2.EmbeddingTables["e1"] = common.NewEmbeddingTable(2, "zero", common.Float32)
+	assert.Nil(t, model2.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}))
 	model2.EmbeddingTables["e1"].SetEmbeddingVectors(is2)
 
-	SaveModelToCheckpoint(tmpDir, model1, 0, bucketNum)
-	SaveModelToCheckpoint(tmpDir, model2, 1, bucketNum)
+	size, err := SaveModelToCheckpoint(tmpDir, model1, 0, bucketNum)
+	assert.Nil(t, err)
+	assert.True(t, size > 0)
+	_, err = SaveModelToCheckpoint(tmpDir, model2, 1, bucketNum)
+	assert.Nil(t, err)
+
+	// a checkpoint directory which cannot be created fails the save
+	_, err = SaveModelToCheckpoint(path.Join(tmpDir, "variables-0-of-2.ckpt", "dir"), model1, 0, bucketNum)
+	assert.NotNil(t, err)
 
 	modelRes1, err1 := LoadModelFromCheckpoint(tmpDir, 0, 3)
 	assert.Nil(t, err1)
@@ -57,22 +66,22 @@ func TestCheckpoint(t *testing.T) {
 	modelRes3, err3 := LoadModelFromCheckpoint(tmpDir, 2, 3)
 	assert.Nil(t, err3)
 
-	assert.Contains(t, modelRes1.EmbeddingTables["e1"].EmbeddingVectors, int64(0))
-	assert.Contains(t, modelRes1.EmbeddingTables["e1"].EmbeddingVectors, int64(3))
+	assert.True(t, modelRes1.EmbeddingTables["e1"].Contains(0))
+	assert.True(t, modelRes1.EmbeddingTables["e1"].Contains(3))
 	ev0 := model1.EmbeddingTables["e1"].GetEmbeddingVector(int64(0))
 	rev0 := modelRes1.EmbeddingTables["e1"].GetEmbeddingVector(int64(0))
 	assert.True(t, common.CompareFloatArray(common.Slice(ev0).([]float32),
 		common.Slice(rev0).([]float32), 0.0001))
 
-	assert.Contains(t, modelRes2.EmbeddingTables["e1"].EmbeddingVectors, int64(1))
-	assert.Contains(t, modelRes2.EmbeddingTables["e1"].EmbeddingVectors, int64(4))
+	assert.True(t, modelRes2.EmbeddingTables["e1"].Contains(1))
+	assert.True(t, modelRes2.EmbeddingTables["e1"].Contains(4))
 	ev1 := model2.EmbeddingTables["e1"].GetEmbeddingVector(int64(1))
 	rev1 := modelRes2.EmbeddingTables["e1"].GetEmbeddingVector(int64(1))
 	assert.True(t, common.CompareFloatArray(common.Slice(ev1).([]float32),
 		common.Slice(rev1).([]float32), 0.0001))
 
-	assert.Contains(t, modelRes3.EmbeddingTables["e1"].EmbeddingVectors, int64(2))
-	assert.Contains(t, modelRes3.EmbeddingTables["e1"].EmbeddingVectors, int64(5))
+	assert.True(t, modelRes3.EmbeddingTables["e1"].Contains(2))
+	assert.True(t, modelRes3.EmbeddingTables["e1"].Contains(5))
 	ev5 := model2.EmbeddingTables["e1"].GetEmbeddingVector(int64(5))
 	rev5 := modelRes3.EmbeddingTables["e1"].GetEmbeddingVector(int64(5))
 	assert.True(t, common.CompareFloatArray(common.Slice(ev5).([]float32),
@@ -80,3 +89,42 @@ func TestCheckpoint(t *testing.T) {
 
 	os.RemoveAll(tmpDir)
 }
+
+func TestCheckpointStringKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestCheckpointStringKeys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	info := &proto.EmbeddingTableInfo{Name: "e1", Dim: 1, Initializer: "zero", Dtype: common.Float32,
+		KeyType: proto.EmbeddingKeyType_STRING_KEY}
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	model := NewModel()
+	assert.Nil(t, model.SetEmbeddingTableInfo(info))
+	slices := &common.IndexedSlices{
+		ConcatTensors: common.NewTensor([]float32{1, 2, 3, 4, 5, 6}, []int64{6, 1}),
+		Keys:          keys,
+	}
+	assert.Nil(t, model.EmbeddingTables["e1"].SetEmbeddingVectors(slices))
+	savedIDs, _ := model.EmbeddingTables["e1"].LookupKeyIDs(keys)
+	_, err = SaveModelToCheckpoint(tmpDir, model, 0, 1)
+	assert.Nil(t, err)
+
+	numRows := 0
+	for shardID := 0; shardID < 2; shardID++ {
+		res, err := LoadModelFromCheckpoint(tmpDir, shardID, 2)
+		assert.Nil(t, err)
+		table := res.EmbeddingTables["e1"]
+		assert.Equal(t, proto.EmbeddingKeyType_STRING_KEY, table.KeyType)
+		numRows += table.Len()
+		for i, key := range keys {
+			if StringToID(key, 2) != shardID {
+				continue
+			}
+			ids, _ := table.LookupKeyIDs([]string{key})
+			assert.Equal(t, savedIDs[i], ids[0])
+			assert.True(t, table.Contains(ids[0]))
+			assert.Equal(t, []float32{float32(i + 1)}, common.Slice(table.GetEmbeddingVector(ids[0])).([]float32))
+		}
+	}
+	assert.Equal(t, len(keys), numRows)
+}
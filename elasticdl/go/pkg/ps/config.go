@@ -0,0 +1,182 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"log/slog"
+	"time"
+
+	"elasticdl.org/elasticdl/pkg/proto"
+)
+
+// ServerConfig is the configuration of a Server
+type ServerConfig struct {
+	ID                    int // a zero-based successive integer number
+	NumPsPods             int
+	OptType               string
+	OptArgs               string
+	MasterAddr            string        // if empty, the PS does not report to the master
+	MasterDialTimeout     time.Duration // 0 means to connect in the background without blocking
+	MasterReportTimeout   time.Duration // 0 means no timeout
+	AdvertiseAddr         string        // the address registered to the master, if empty, the listening address
+	HeartbeatInterval     time.Duration // 0, the default, means not to register to the master or heartbeat
+	EvaluationStep        int
+	CheckpointDirForInit  string
+	CheckpointDir         string
+	CheckpointStep        int
+	KeepCheckpointMax     int
+	LRStalenessModulation bool
+	NumGradThreads        int // 0 means the number of CPUs
+	Hogwild               bool
+	EmbeddingDiskDir      string
+	EmbeddingDefaults     *proto.EmbeddingTableInfo // policies of embedding tables which do not set them, if not nil
+	Logger                *slog.Logger              // if nil, the default logger
+}
+
+// ServerOption sets fields of a ServerConfig
+type ServerOption func(*ServerConfig)
+
+// DefaultServerConfig returns the configuration of a Server without options
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		NumPsPods:           1,
+		MasterDialTimeout:   time.Minute,
+		MasterReportTimeout: 10 * time.Second,
+		KeepCheckpointMax:   3,
+	}
+}
+
+func newServerConfig(opts []ServerOption) ServerConfig {
+	config := DefaultServerConfig()
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return config
+}
+
+// WithConfig replaces the whole configuration with config, later options still apply.
+// Zero fields are not defaulted, so config should start from DefaultServerConfig.
+func WithConfig(config ServerConfig) ServerOption {
+	return func(c *ServerConfig) {
+		*c = config
+	}
+}
+
+// WithID sets the id of the PS among numPsPods PS pods
+func WithID(ID int, numPsPods int) ServerOption {
+	return func(c *ServerConfig) {
+		c.ID = ID
+		c.NumPsPods = numPsPods
+	}
+}
+
+// WithOptimizer sets the optimizer type and its arguments, see NewOptimizer
+func WithOptimizer(optType string, optArgs string) ServerOption {
+	return func(c *ServerConfig) {
+		c.OptType = optType
+		c.OptArgs = optArgs
+	}
+}
+
+// WithMaster sets the master address, the timeout to connect to it, and reports
+// the model version to it every evaluationStep versions if evaluationStep is positive.
+// If dialTimeout is 0, NewServer does not wait for the master and the connection
+// is retried until the master is reachable.
+func WithMaster(addr string, dialTimeout time.Duration, evaluationStep int) ServerOption {
+	return func(c *ServerConfig) {
+		c.MasterAddr = addr
+		c.MasterDialTimeout = dialTimeout
+		c.EvaluationStep = evaluationStep
+	}
+}
+
+// WithMasterReportTimeout sets the timeout of each model version report to the master
+func WithMasterReportTimeout(timeout time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.MasterReportTimeout = timeout
+	}
+}
+
+// WithHeartbeat registers the PS at addr to the master and sends a heartbeat every
+// interval, heartbeats are disabled unless interval is positive. The master relaunches
+// a PS which stops sending heartbeats, so they are only enabled for a master which
+// expects them. If addr is empty, the address the PS listens on is registered.
+func WithHeartbeat(addr string, interval time.Duration) ServerOption {
+	return func(c *ServerConfig) {
+		c.AdvertiseAddr = addr
+		c.HeartbeatInterval = interval
+	}
+}
+
+// WithCheckpointDirForInit restores the model from the checkpoint in dir
+func WithCheckpointDirForInit(dir string) ServerOption {
+	return func(c *ServerConfig) {
+		c.CheckpointDirForInit = dir
+	}
+}
+
+// WithCheckpoint saves a checkpoint to dir every step versions and keeps the last keepMax ones
+func WithCheckpoint(dir string, step int, keepMax int) ServerOption {
+	return func(c *ServerConfig) {
+		c.CheckpointDir = dir
+		c.CheckpointStep = step
+		c.KeepCheckpointMax = keepMax
+	}
+}
+
+// WithLRStalenessModulation sets whether to divide the learning rate by the staleness of gradients
+func WithLRStalenessModulation(enabled bool) ServerOption {
+	return func(c *ServerConfig) {
+		c.LRStalenessModulation = enabled
+	}
+}
+
+// WithNumGradThreads sets the number of goroutines to apply gradients
+func WithNumGradThreads(num int) ServerOption {
+	return func(c *ServerConfig) {
+		c.NumGradThreads = num
+	}
+}
+
+// WithHogwild sets whether to apply gradients without waiting for each other and serve pulls without parameter locks
+func WithHogwild(enabled bool) ServerOption {
+	return func(c *ServerConfig) {
+		c.Hogwild = enabled
+	}
+}
+
+// WithEmbeddingDiskDir sets the directory of embedding tables with disk storage
+func WithEmbeddingDiskDir(dir string) ServerOption {
+	return func(c *ServerConfig) {
+		c.EmbeddingDiskDir = dir
+	}
+}
+
+// WithEmbeddingDefaults sets the policies of embedding tables whose infos do not set them,
+// such as MaxRows, Ttl and AdmissionThreshold, see Model.SetEmbeddingTableInfo
+func WithEmbeddingDefaults(defaults *proto.EmbeddingTableInfo) ServerOption {
+	return func(c *ServerConfig) {
+		c.EmbeddingDefaults = defaults
+	}
+}
+
+// WithLogger sets the logger of the PS, which adds the ps_id field
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(c *ServerConfig) {
+		c.Logger = logger
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// pserverService is the name of the Pserver service in health checks
+const pserverService = "proto.Pserver"
+
+// setReady sets whether the PS is ready to serve, which is reported by the health service
+func (s *Server) setReady(ready bool) {
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if ready {
+		atomic.StoreInt32(&s.ready, 1)
+		status = healthpb.HealthCheckResponse_SERVING
+	} else {
+		atomic.StoreInt32(&s.ready, 0)
+	}
+	s.health.SetServingStatus("", status)
+	s.health.SetServingStatus(pserverService, status)
+}
+
+// isReady returns whether the model is initialized
+func (s *Server) isReady() bool {
+	return atomic.LoadInt32(&s.ready) == 1
+}
+
+// restoreCheckpoint loads the model from checkpointDirForInit and unlocks the server.
+// The caller holds the server lock for write. The model stays uninitialized and
+// server is stopped if the checkpoint fails to load.
+func (s *Server) restoreCheckpoint(server *grpc.Server) {
+	defer s.lock.Unlock()
+	logger := s.logger.With("checkpoint_dir", s.checkpointDirForInit)
+	logger.Info("Restoring the model")
+	if err := loadCheckpoint(s.Model, s.checkpointDirForInit, s.ID, s.numPsPods); err != nil {
+		logger.Error("Failed to load from checkpoint", "error", err)
+		s.setErr(fmt.Errorf("Failed to load from checkpoint %s: %v", s.checkpointDirForInit, err))
+		go server.Stop()
+		return
+	}
+	s.Model.Initialized = true
+	s.setReady(true)
+	logger.Info("Restored the model", "model_version", s.Model.GetVersion())
+}
+
+// handleLiveness reports that the PS process is alive
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadiness reports whether the PS is ready to serve
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	if !s.isReady() {
+		http.Error(w, "model not initialized", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
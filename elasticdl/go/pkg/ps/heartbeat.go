@@ -0,0 +1,170 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"elasticdl.org/elasticdl/pkg/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// psStatus returns the status reported to the master. Once the model is ready,
+// the table sizes are read under the server lock, and each parameter lock is taken
+// for read, so a PS hung with the server lock or a parameter lock held for write
+// stops sending heartbeats and the master finds it hung. A push stuck in Hogwild
+// mode, which holds parameter locks for read, shows in OldestRpcAgeSecs instead.
+func (s *Server) psStatus() *proto.PsStatus {
+	addr := s.advertiseAddr
+	if addr == "" {
+		addr = s.Addr()
+	}
+	psStatus := &proto.PsStatus{
+		PsId:                  int32(s.ID),
+		Addr:                  addr,
+		NumPsPods:             int32(s.numPsPods),
+		ModelVersion:          s.Model.GetVersion(),
+		Ready:                 s.isReady(),
+		HeartbeatIntervalSecs: int32((s.heartbeatInterval + time.Second - 1) / time.Second),
+		OldestRpcAgeSecs:      int64(s.inflight.oldestAge() / time.Second),
+	}
+	if psStatus.Ready {
+		psStatus.EmbeddingTableRows = make(map[string]int64)
+		s.lock.RLock()
+		s.Model.waitParameterLocks()
+		for name, table := range s.Model.EmbeddingTables {
+			psStatus.EmbeddingTableRows[name] = int64(table.Len())
+		}
+		s.lock.RUnlock()
+	}
+	return psStatus
+}
+
+// inflightRPCs tracks the start times of the RPCs in flight, so that heartbeats
+// report how long the oldest one has been running
+type inflightRPCs struct {
+	lock   sync.Mutex
+	next   uint64
+	starts map[uint64]time.Time
+}
+
+// start records an RPC starting now and returns its id
+func (r *inflightRPCs) start() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.starts == nil {
+		r.starts = make(map[uint64]time.Time)
+	}
+	r.next++
+	r.starts[r.next] = time.Now()
+	return r.next
+}
+
+// end records the end of the RPC of an id
+func (r *inflightRPCs) end(id uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.starts, id)
+}
+
+// oldestAge returns how long the oldest RPC in flight has been running, 0 if none
+func (r *inflightRPCs) oldestAge() time.Duration {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var oldest time.Duration
+	for _, start := range r.starts {
+		if age := time.Since(start); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// unaryInterceptor tracks the RPC while it is in flight
+func (r *inflightRPCs) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	id := r.start()
+	defer r.end(id)
+	return handler(ctx, req)
+}
+
+// runHeartbeats registers the PS to the master and sends a heartbeat every
+// heartbeatInterval until ctx is done. The PS registers again if the master
+// does not know it, and stops if the master does not support heartbeats.
+// Heartbeats report how long the model version has not changed, so that the
+// master sees whether the PS makes progress.
+func (s *Server) runHeartbeats(ctx context.Context) {
+	registered := false
+	version, versionTime := s.Model.GetVersion(), time.Now()
+	for {
+		var err error
+		psStatus := s.psStatus()
+		if psStatus.ModelVersion != version {
+			version, versionTime = psStatus.ModelVersion, time.Now()
+		}
+		psStatus.VersionUnchangedSecs = int64(time.Since(versionTime) / time.Second)
+		if registered {
+			var known bool
+			if known, err = s.masterClient.psHeartbeat(ctx, psStatus); err == nil && !known {
+				s.logger.Info("The master does not know the PS, registering again")
+				registered = false
+				continue
+			}
+		} else if err = s.masterClient.registerPs(ctx, psStatus); err == nil {
+			registered = true
+			s.logger.Info("Registered to the master", "interval", s.heartbeatInterval)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			s.logger.Info("The master does not support PS heartbeats", "error", err)
+			return
+		}
+		if err != nil {
+			s.logger.Warn("Failed to send the heartbeat to master", "registered", registered, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.heartbeatInterval):
+		}
+	}
+}
+
+// registerPs registers the PS of psStatus to the master within reportTimeout
+func (c *MasterClient) registerPs(ctx context.Context, psStatus *proto.PsStatus) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	_, err := c.client.RegisterPs(ctx, psStatus, grpc.WaitForReady(true))
+	c.metrics.heartbeats.WithLabelValues("register_ps", status.Code(err).String()).Inc()
+	return err
+}
+
+// psHeartbeat sends a heartbeat to the master within reportTimeout and returns
+// whether the master knows the PS
+func (c *MasterClient) psHeartbeat(ctx context.Context, psStatus *proto.PsStatus) (bool, error) {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	resp, err := c.client.PsHeartbeat(ctx, psStatus, grpc.WaitForReady(true))
+	c.metrics.heartbeats.WithLabelValues("ps_heartbeat", status.Code(err).String()).Inc()
+	if err != nil {
+		return false, err
+	}
+	return resp.Registered, nil
+}
@@ -0,0 +1,186 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Hogwild updates race with each other by design, so these tests do not run
+// with the race detector.
+
+//go:build !race
+
+package ps
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"elasticdl.org/elasticdl/pkg/common"
+	"elasticdl.org/elasticdl/pkg/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/tensor_go_proto"
+)
+
+func TestHogwildPushGradients(t *testing.T) {
+	const workers = 8
+	const steps = 50
+	s := newTestServer(t, WithHogwild(true), WithNumGradThreads(4))
+	model := &proto.Model{
+		DenseParameters: make(map[string]*tensor_go_proto.TensorProto),
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{
+			{Name: "e1", Dim: 4, Initializer: "zero", Dtype: common.Float32},
+		},
+	}
+	for w := 0; w < workers; w++ {
+		model.DenseParameters[fmt.Sprintf("t%d", w)] = common.NewTensor(make([]float32, 4), []int64{4}).SerializeToTensorProto()
+	}
+	_, err := s.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+
+	// each worker updates its own dense parameter and embedding row, so no update
+	// races with another and every gradient must be applied
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			ones := []float32{1, 1, 1, 1}
+			grads := &proto.Model{
+				DenseParameters: map[string]*tensor_go_proto.TensorProto{
+					fmt.Sprintf("t%d", w): common.NewTensor(ones, []int64{4}).SerializeToTensorProto(),
+				},
+				EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+					"e1": common.NewIndexedSlices(common.NewTensor(ones, []int64{1, 4}),
+						[]int64{int64(w)}).SerializeToIndexedSlicesProto(),
+				},
+			}
+			for i := 0; i < steps; i++ {
+				resp, err := s.PushGradients(context.Background(),
+					&proto.PushGradientsRequest{Gradients: grads, LearningRate: 0.5})
+				assert.Nil(t, err)
+				assert.True(t, resp.Accepted)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(workers*steps), s.Model.GetVersion())
+	expected := []float32{-0.5 * steps, -0.5 * steps, -0.5 * steps, -0.5 * steps}
+	for w := 0; w < workers; w++ {
+		assert.Equal(t, expected, common.Slice(s.Model.GetDenseParameter(fmt.Sprintf("t%d", w))).([]float32))
+		assert.Equal(t, expected, common.Slice(s.Model.GetEmbeddingTable("e1").GetEmbeddingVector(int64(w))).([]float32))
+	}
+}
+
+func TestHogwildEviction(t *testing.T) {
+	const dim = 256
+	s := newTestServer(t, WithHogwild(true), WithNumGradThreads(4))
+	model := &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{
+			{Name: "e1", Dim: dim, Initializer: "zero", Dtype: common.Float32, MaxRows: 32},
+		},
+	}
+	_, err := s.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+
+	// the gradient of id k is [-k, ..., -k, -1], so each row stays proportional to
+	// [k, ..., k, 1] unless an update writes to the row of another id after it is evicted
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < 200; i++ {
+				ids := make([]int64, 16)
+				values := make([]float32, 0, len(ids)*dim)
+				for j := range ids {
+					ids[j] = r.Int63n(199) + 1
+					for k := 0; k < dim-1; k++ {
+						values = append(values, -float32(ids[j]))
+					}
+					values = append(values, -1)
+				}
+				grad := common.NewIndexedSlices(common.NewTensor(values, []int64{int64(len(ids)), dim}), ids)
+				_, err := s.PushGradients(context.Background(), &proto.PushGradientsRequest{
+					Gradients: &proto.Model{
+						EmbeddingTables: map[string]*proto.IndexedSlicesProto{"e1": grad.SerializeToIndexedSlicesProto()},
+					},
+				})
+				assert.Nil(t, err)
+			}
+		}(int64(g))
+	}
+	wg.Wait()
+
+	table := s.Model.GetEmbeddingTable("e1")
+	assert.True(t, table.GetEvictionStats().LeastRecentlyUsed > 0)
+	rows := table.ToIndexedSlices()
+	for i, id := range rows.Ids {
+		row := common.Slice(rows.ConcatTensors.GetRow(int64(i))).([]float32)
+		if row[dim-1] == 0 {
+			continue
+		}
+		for _, v := range row[:dim-1] {
+			if !assert.InDelta(t, float32(id), v/row[dim-1], 0.01, "the row of id %d", id) {
+				break
+			}
+		}
+	}
+}
+
+func TestHogwildLocks(t *testing.T) {
+	s := newTestServer(t, WithHogwild(true))
+	model := &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{
+			{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32, MaxRows: 1},
+		},
+	}
+	_, err := s.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+	table := s.Model.GetEmbeddingTable("e1")
+	table.GetEmbeddingVector(1)
+
+	// updates do not wait for each other, and eviction only waits for them once it is due
+	unlock := s.Model.lockParameters([]string{"e1"})
+	s.Model.lockParameters([]string{"e1"})()
+	checked := make(chan struct{})
+	go func() {
+		s.evictEmbeddingRows(1)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("eviction waits for updates before it is due")
+	}
+	table.GetEmbeddingVectors([]int64{2, 3})
+	evicted := make(chan struct{})
+	go func() {
+		s.evictEmbeddingRows(1)
+		close(evicted)
+	}()
+	select {
+	case <-evicted:
+		t.Fatal("rows are evicted during an update")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case <-evicted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rows are not evicted after the update")
+	}
+	assert.Equal(t, int64(2), table.GetEvictionStats().LeastRecentlyUsed)
+}
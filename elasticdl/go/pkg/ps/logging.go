@@ -0,0 +1,48 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"context"
+	"time"
+
+	"elasticdl.org/elasticdl/pkg/logging"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// logInterceptor passes a logger with the method, the worker peer and the trace id
+// of an RPC to the handler in the context. Failed RPCs are logged at the error
+// level and the others at the debug level.
+func (s *Server) logInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	logger := s.logger.With("method", info.FullMethod)
+	if p, ok := peer.FromContext(ctx); ok {
+		logger = logger.With("peer", p.Addr.String())
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	start := time.Now()
+	resp, err := handler(logging.NewContext(ctx, logger), req)
+	if err != nil {
+		logger.Error("RPC failed", "code", status.Code(err).String(), "model_version", s.Model.GetVersion(),
+			"duration", time.Since(start), "error", err)
+	} else {
+		logger.Debug("RPC finished", "model_version", s.Model.GetVersion(), "duration", time.Since(start))
+	}
+	return resp, err
+}
@@ -0,0 +1,212 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"elasticdl.org/elasticdl/pkg/proto"
+	"elasticdl.org/elasticdl/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minMasterReportBackoff = 100 * time.Millisecond
+	maxMasterReportBackoff = 10 * time.Second
+)
+
+// MasterClient contains attributes to call master GRPC services. Model versions
+// are reported in the background, see reportVersionAsync.
+type MasterClient struct {
+	client        proto.MasterClient
+	context       context.Context
+	cancel        context.CancelFunc
+	clientConn    *grpc.ClientConn
+	reportTimeout time.Duration // 0 means no timeout
+	metrics       *serverMetrics
+	logger        *slog.Logger
+	lock          sync.Mutex
+	hasPending    bool
+	pending       int32             // the latest version waiting to be reported
+	pendingSpan   trace.SpanContext // the span which asked to report pending
+	wake          chan struct{}
+	stopped       chan struct{}
+	closeOnce     sync.Once
+}
+
+// createMasterClient connects to the master at masterAddr and starts reporting
+// in the background. If timeout is 0, the connection is made in the background.
+// Either way, a lost connection is made again with backoff up to maxMasterReportBackoff.
+func createMasterClient(masterAddr string, timeout time.Duration, reportTimeout time.Duration,
+	metrics *serverMetrics, logger *slog.Logger) (*MasterClient, error) {
+	if masterAddr == "" {
+		return nil, nil
+	}
+	connectBackoff := backoff.DefaultConfig
+	connectBackoff.BaseDelay = minMasterReportBackoff
+	connectBackoff.MaxDelay = maxMasterReportBackoff
+	opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithUnaryInterceptor(tracing.UnaryClientInterceptor),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: connectBackoff, MinConnectTimeout: 5 * time.Second})}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+		opts = append(opts, grpc.WithBlock())
+	}
+	// without a timeout, the connection is made in the background and retried
+	// with backoff until the master is reachable
+	conn, err := grpc.DialContext(ctx, masterAddr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to master %s: %v", masterAddr, err)
+	}
+	c := &MasterClient{
+		client:        proto.NewMasterClient(conn),
+		clientConn:    conn,
+		reportTimeout: reportTimeout,
+		metrics:       metrics,
+		logger:        logger,
+		wake:          make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
+	}
+	c.context, c.cancel = context.WithCancel(context.Background())
+	go c.runReports()
+	return c, nil
+}
+
+// reportVersion reports the model version to the master within reportTimeout,
+// waiting for the connection to be made meanwhile. The RPC joins the trace of
+// ctx but is not canceled with ctx.
+func (c *MasterClient) reportVersion(ctx context.Context, modelVersion int32) error {
+	ctx, cancel := c.callContext(ctx)
+	defer cancel()
+	var request proto.ReportVersionRequest
+	request.ModelVersion = modelVersion
+	start := time.Now()
+	_, err := c.client.ReportVersion(ctx, &request, grpc.WaitForReady(true))
+	c.metrics.observeMasterReport(modelVersion, time.Since(start), err)
+	return err
+}
+
+// callContext returns the context of an RPC to the master which joins the trace
+// of ctx, is canceled by closeConn and times out after reportTimeout
+func (c *MasterClient) callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = trace.ContextWithSpan(c.context, trace.SpanFromContext(ctx))
+	if c.reportTimeout > 0 {
+		return context.WithTimeout(ctx, c.reportTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// reportVersionAsync queues the model version to be reported in the background
+// without blocking. Only the latest version matters to the master, so a queued
+// version which is not reported yet is replaced by a later one.
+func (c *MasterClient) reportVersionAsync(ctx context.Context, modelVersion int32) {
+	c.lock.Lock()
+	if c.hasPending {
+		if modelVersion <= c.pending {
+			c.lock.Unlock()
+			return
+		}
+		c.metrics.coalescedReports.Inc()
+	}
+	c.hasPending = true
+	c.pending = modelVersion
+	c.pendingSpan = trace.SpanContextFromContext(ctx)
+	c.lock.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takePending returns the queued version and the span which queued it, if any
+func (c *MasterClient) takePending() (int32, trace.SpanContext, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.hasPending {
+		return 0, trace.SpanContext{}, false
+	}
+	c.hasPending = false
+	return c.pending, c.pendingSpan, true
+}
+
+// runReports reports queued versions until closeConn. A failed report is
+// retried with exponential backoff unless a later version is queued meanwhile.
+func (c *MasterClient) runReports() {
+	defer close(c.stopped)
+	retryIn := minMasterReportBackoff
+	for {
+		select {
+		case <-c.context.Done():
+			return
+		case <-c.wake:
+		}
+		version, spanContext, ok := c.takePending()
+		if !ok {
+			continue
+		}
+		ctx := trace.ContextWithSpanContext(c.context, spanContext)
+		ctx, span := tracing.Start(ctx, "reportVersion", attribute.Int("version", int(version)))
+		err := c.reportVersion(ctx, version)
+		tracing.End(span, err)
+		if err == nil {
+			retryIn = minMasterReportBackoff
+			continue
+		}
+		if c.context.Err() != nil {
+			return
+		}
+		c.logger.Warn("Failed to report model version to master",
+			"model_version", version, "retry_in", retryIn, "error", err)
+		c.reportVersionAsync(trace.ContextWithSpanContext(c.context, spanContext), version)
+		select {
+		case <-c.context.Done():
+			return
+		case <-time.After(retryIn):
+		}
+		if retryIn *= 2; retryIn > maxMasterReportBackoff {
+			retryIn = maxMasterReportBackoff
+		}
+	}
+}
+
+// closeConn stops reporting, a queued version which is not reported yet is dropped
+func (c *MasterClient) closeConn() {
+	if c == nil {
+		return
+	}
+	c.closeOnce.Do(func() {
+		c.cancel()
+		<-c.stopped
+		c.clientConn.Close()
+	})
+}
+
+// observeMasterReport records a report of modelVersion to the master
+func (m *serverMetrics) observeMasterReport(modelVersion int32, duration time.Duration, err error) {
+	m.masterReportDuration.Observe(duration.Seconds())
+	m.masterReports.WithLabelValues(status.Code(err).String()).Inc()
+	if err == nil {
+		m.reportedVersion.Set(float64(modelVersion))
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	minMasterWatchBackoff = 100 * time.Millisecond
+	maxMasterWatchBackoff = 5 * time.Second
+)
+
+// WatchMaster returns a channel which is closed once the master is lost, that
+// is, the master has not been SERVING in gRPC health checks for lostTimeout.
+// A master without the health service counts as serving while it answers.
+// The master is watched until ctx is done. If there is no master address, the
+// channel is never closed.
+func (s *Server) WatchMaster(ctx context.Context, lostTimeout time.Duration) <-chan struct{} {
+	lost := make(chan struct{})
+	if s.masterClient == nil {
+		return lost
+	}
+	client := healthpb.NewHealthClient(s.masterClient.clientConn)
+	go func() {
+		backoff := minMasterWatchBackoff
+		var lostSince time.Time
+		for {
+			serving, err := watchHealth(ctx, client)
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case serving || status.Code(err) == codes.Unimplemented:
+				lostSince = time.Time{}
+				if serving {
+					backoff = minMasterWatchBackoff
+				}
+			case lostSince.IsZero():
+				lostSince = time.Now()
+			case time.Since(lostSince) >= lostTimeout:
+				s.logger.Warn("Lost the master", "lost_for", time.Since(lostSince), "error", err)
+				close(lost)
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxMasterWatchBackoff {
+				backoff = maxMasterWatchBackoff
+			}
+		}
+	}()
+	return lost
+}
+
+// watchHealth watches the health of the server until it is not SERVING or the
+// watch fails. It returns whether the server has been SERVING in the watch.
+func watchHealth(ctx context.Context, client healthpb.HealthClient) (bool, error) {
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return false, err
+	}
+	serving := false
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return serving, err
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return serving, status.Errorf(codes.Unavailable, "master is %v", resp.Status)
+		}
+		serving = true
+	}
+}
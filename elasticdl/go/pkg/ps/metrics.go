@@ -0,0 +1,200 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ps
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// serverMetrics are the metrics of a PS exposed at /metrics. Each server has its
+// own registry, so that servers in the same process do not share metrics.
+type serverMetrics struct {
+	registry             *prometheus.Registry
+	rpcRequests          *prometheus.CounterVec
+	rpcDuration          *prometheus.HistogramVec
+	gradientPushes       prometheus.Counter
+	rejectedPushes       prometheus.Counter
+	staleness            prometheus.Histogram
+	checkpointDuration   prometheus.Histogram
+	checkpointSize       prometheus.Gauge
+	masterReports        *prometheus.CounterVec
+	masterReportDuration prometheus.Histogram
+	coalescedReports     prometheus.Counter
+	reportedVersion      prometheus.Gauge
+	heartbeats           *prometheus.CounterVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		rpcRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "elasticdl_ps_rpc_requests_total",
+			Help: "Number of RPCs handled by the PS.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "elasticdl_ps_rpc_duration_seconds",
+			Help:    "Latency of RPCs handled by the PS.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"method"}),
+		gradientPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "elasticdl_ps_gradient_pushes_total",
+			Help: "Number of gradient pushes applied to the model.",
+		}),
+		rejectedPushes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "elasticdl_ps_rejected_gradient_pushes_total",
+			Help: "Number of gradient pushes rejected by the PS.",
+		}),
+		staleness: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "elasticdl_ps_gradient_staleness",
+			Help:    "Model versions between pushed gradients and the model.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		checkpointDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "elasticdl_ps_checkpoint_duration_seconds",
+			Help:    "Time to save a checkpoint.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		checkpointSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "elasticdl_ps_checkpoint_size_bytes",
+			Help: "Size of the last checkpoint saved by the PS.",
+		}),
+		masterReports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "elasticdl_ps_master_reports_total",
+			Help: "Number of model version reports to the master.",
+		}, []string{"code"}),
+		masterReportDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "elasticdl_ps_master_report_duration_seconds",
+			Help:    "Latency of model version reports to the master.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}),
+		coalescedReports: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "elasticdl_ps_master_coalesced_reports_total",
+			Help: "Number of model version reports replaced by a later version before they are sent.",
+		}),
+		reportedVersion: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "elasticdl_ps_master_reported_version",
+			Help: "Model version last reported to the master.",
+		}),
+		heartbeats: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "elasticdl_ps_master_heartbeats_total",
+			Help: "Number of registrations and heartbeats sent to the master.",
+		}, []string{"method", "code"}),
+	}
+	m.registry.MustRegister(m.rpcRequests, m.rpcDuration, m.gradientPushes, m.rejectedPushes, m.staleness,
+		m.checkpointDuration, m.checkpointSize, m.masterReports, m.masterReportDuration, m.coalescedReports,
+		m.reportedVersion, m.heartbeats, &modelCollector{s},
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+var (
+	modelVersionDesc  = prometheus.NewDesc("elasticdl_ps_model_version", "Version of the model.", nil, nil)
+	optimizerStepDesc = prometheus.NewDesc("elasticdl_ps_optimizer_step", "Number of optimizer steps.", nil, nil)
+	embeddingRowsDesc = prometheus.NewDesc("elasticdl_ps_embedding_rows",
+		"Number of rows of an embedding table.", []string{"table"}, nil)
+	embeddingMemoryDesc = prometheus.NewDesc("elasticdl_ps_embedding_memory_bytes",
+		"Memory of the rows of an embedding table.", []string{"table"}, nil)
+)
+
+// modelCollector collects the metrics of the model, which are only known at scrape time
+type modelCollector struct {
+	s *Server
+}
+
+// Describe implements prometheus.Collector
+func (c *modelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- modelVersionDesc
+	ch <- optimizerStepDesc
+	ch <- embeddingRowsDesc
+	ch <- embeddingMemoryDesc
+}
+
+// Collect implements prometheus.Collector. It does not take the server lock, so
+// scrapes are not blocked while the model is restored or checkpointed. The sizes of
+// a table are read under the locks of its shards.
+func (c *modelCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	ch <- prometheus.MustNewConstMetric(modelVersionDesc, prometheus.GaugeValue, float64(s.Model.GetVersion()))
+	ch <- prometheus.MustNewConstMetric(optimizerStepDesc, prometheus.GaugeValue, float64(s.Opt.GetStep()))
+	for name, table := range s.Model.listEmbeddingTables() {
+		ch <- prometheus.MustNewConstMetric(embeddingRowsDesc, prometheus.GaugeValue, float64(table.Len()), name)
+		ch <- prometheus.MustNewConstMetric(embeddingMemoryDesc, prometheus.GaugeValue,
+			float64(table.MemoryBytes()), name)
+	}
+}
+
+// handler returns the HTTP handler serving the metrics
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// unaryInterceptor counts RPCs and observes their latency
+func (m *serverMetrics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	m.rpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// observePush records a gradient push of a version to a model of another version
+func (m *serverMetrics) observePush(accepted bool, gradVersion int32, modelVersion int32) {
+	if !accepted {
+		m.rejectedPushes.Inc()
+		return
+	}
+	m.gradientPushes.Inc()
+	staleness := modelVersion - gradVersion
+	if staleness < 0 {
+		staleness = 0
+	}
+	m.staleness.Observe(float64(staleness))
+}
+
+// observeCheckpoint records the duration and the size of a checkpoint
+func (m *serverMetrics) observeCheckpoint(duration time.Duration, size int) {
+	m.checkpointDuration.Observe(duration.Seconds())
+	m.checkpointSize.Set(float64(size))
+}
+
+// RunHTTP starts an HTTP server at address for /metrics, the liveness probe /healthz
+// and the readiness probe /readyz
+func (s *Server) RunHTTP(address string) (*http.Server, error) {
+	lis, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start the HTTP server at %s: %v", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.handler())
+	mux.HandleFunc("/healthz", s.handleLiveness)
+	mux.HandleFunc("/readyz", s.handleReadiness)
+	server := &http.Server{Addr: address, Handler: mux}
+	go func() {
+		if err := server.Serve(lis); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("HTTP server failed to serve", "address", address, "error", err)
+		}
+	}()
+	return server, nil
+}
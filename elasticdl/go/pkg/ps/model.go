@@ -15,18 +15,35 @@ package ps
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	"elasticdl.org/elasticdl/pkg/common"
 	"elasticdl.org/elasticdl/pkg/proto"
 	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/tensor_go_proto"
 )
 
-// Model contains dense parameters and embedding tables
+// Model contains dense parameters and embedding tables.
+// Version must be accessed atomically once the model is being served. Each
+// parameter has its own RWMutex. In Hogwild mode, updates only lock it for read,
+// and pulls skip it.
+// Embedding tables with disk storage keep their files under EmbeddingDiskDir,
+// a temporary directory is created if it is empty. EmbeddingTableDefaults, if
+// not nil, gives the policies of embedding tables which do not set them.
 type Model struct {
-	DenseParameters map[string]*common.Tensor
-	EmbeddingTables map[string]*common.EmbeddingTable
-	Version         int32
-	Initialized     bool
+	DenseParameters        map[string]*common.Tensor
+	EmbeddingTables        map[string]*common.EmbeddingTable
+	Version                int32
+	Initialized            bool
+	Hogwild                bool
+	EmbeddingDiskDir       string
+	EmbeddingTableDefaults *proto.EmbeddingTableInfo
+	paramLocks             sync.Map
+	tablesLock             sync.RWMutex // guards adding embedding tables against listEmbeddingTables
 }
 
 // NewModel creates a model instance
@@ -53,19 +70,145 @@ func (model *Model) GetEmbeddingTable(name string) *common.EmbeddingTable {
 	return nil
 }
 
-// SetEmbeddingTableInfo sets embedding table info of an embedding param
-func (model *Model) SetEmbeddingTableInfo(info *proto.EmbeddingTableInfo) {
+// listEmbeddingTables returns the embedding tables by name. Unlike EmbeddingTables,
+// it may be used by callers which do not lock the model, e.g. while it is restored.
+func (model *Model) listEmbeddingTables() map[string]*common.EmbeddingTable {
+	model.tablesLock.RLock()
+	defer model.tablesLock.RUnlock()
+	tables := make(map[string]*common.EmbeddingTable, len(model.EmbeddingTables))
+	for name, table := range model.EmbeddingTables {
+		tables[name] = table
+	}
+	return tables
+}
+
+// GetVersion returns the model version
+func (model *Model) GetVersion() int32 {
+	return atomic.LoadInt32(&model.Version)
+}
+
+func (model *Model) paramLock(name string) *sync.RWMutex {
+	lock, _ := model.paramLocks.LoadOrStore(name, &sync.RWMutex{})
+	return lock.(*sync.RWMutex)
+}
+
+// lockParameters locks parameters for update and returns the function to unlock them.
+// In Hogwild mode, they are locked for read, so that updates do not wait for each
+// other but still exclude lockParametersExclusive.
+func (model *Model) lockParameters(names []string) func() {
+	return model.lockSorted(names, model.Hogwild)
+}
+
+// lockParametersExclusive locks parameters for write even in Hogwild mode, for
+// changes such as evicting rows, which must not happen while a kernel writes
+// through views of the rows.
+func (model *Model) lockParametersExclusive(names []string) func() {
+	return model.lockSorted(names, false)
+}
+
+// lockSorted locks names in sorted order to avoid deadlocks between concurrent
+// updates, for read if shared, and returns the function to unlock them
+func (model *Model) lockSorted(names []string, shared bool) func() {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	locks := make([]*sync.RWMutex, len(sorted))
+	for i, name := range sorted {
+		locks[i] = model.paramLock(name)
+		if shared {
+			locks[i].RLock()
+		} else {
+			locks[i].Lock()
+		}
+	}
+	return func() {
+		for i := len(locks) - 1; i >= 0; i-- {
+			if shared {
+				locks[i].RUnlock()
+			} else {
+				locks[i].Unlock()
+			}
+		}
+	}
+}
+
+// rLockParameter locks a parameter for read and returns the function to unlock it
+func (model *Model) rLockParameter(name string) func() {
+	if model.Hogwild {
+		return func() {}
+	}
+	lock := model.paramLock(name)
+	lock.RLock()
+	return lock.RUnlock
+}
+
+// waitParameterLocks locks each parameter for read and unlocks it at once, so it
+// waits while a parameter is locked for write, even in Hogwild mode
+func (model *Model) waitParameterLocks() {
+	model.paramLocks.Range(func(_, lock interface{}) bool {
+		lock.(*sync.RWMutex).RLock()
+		lock.(*sync.RWMutex).RUnlock()
+		return true
+	})
+}
+
+// SetEmbeddingTableInfo sets embedding table info of an embedding param. The
+// policies info does not set are set from EmbeddingTableDefaults, in info as well,
+// so that the optimizer creates slot tables alike.
+func (model *Model) SetEmbeddingTableInfo(info *proto.EmbeddingTableInfo) error {
+	if defaults := model.EmbeddingTableDefaults; defaults != nil {
+		if info.MaxRows == 0 {
+			info.MaxRows = defaults.MaxRows
+		}
+		if info.Ttl == 0 {
+			info.Ttl = defaults.Ttl
+		}
+		if info.AdmissionThreshold == 0 {
+			info.AdmissionThreshold = defaults.AdmissionThreshold
+		}
+		if info.AdmissionSketchWidth == 0 {
+			info.AdmissionSketchWidth = defaults.AdmissionSketchWidth
+		}
+	}
 	if _, ok := model.EmbeddingTables[info.Name]; ok {
-		return
+		return nil
+	}
+	t, err := common.NewEmbeddingTableFromInfo(info)
+	if err != nil {
+		return err
 	}
-	t := common.NewEmbeddingTable(info.Dim, info.Initializer, info.Dtype)
+	if t.CacheRows > 0 {
+		if model.EmbeddingDiskDir == "" {
+			if model.EmbeddingDiskDir, err = ioutil.TempDir("", "elasticdl_embedding"); err != nil {
+				return err
+			}
+		}
+		dir := filepath.Join(model.EmbeddingDiskDir, url.PathEscape(info.Name))
+		if err = t.OpenDiskStorage(dir); err != nil {
+			return fmt.Errorf("Embedding table %s: %v", info.Name, err)
+		}
+	}
+	model.tablesLock.Lock()
 	model.EmbeddingTables[info.Name] = t
+	model.tablesLock.Unlock()
+	return nil
+}
+
+// Close closes the disk storage of embedding tables
+func (model *Model) Close() error {
+	for name, table := range model.EmbeddingTables {
+		if err := table.Close(); err != nil {
+			return fmt.Errorf("Embedding table %s: %v", name, err)
+		}
+	}
+	return nil
 }
 
 // InitFromModelPB inits the model from model PB
 func (model *Model) InitFromModelPB(pb *proto.Model) error {
 	for _, v := range pb.EmbeddingTableInfos {
-		model.SetEmbeddingTableInfo(v)
+		if err := model.SetEmbeddingTableInfo(v); err != nil {
+			return err
+		}
 	}
 	for name, v := range pb.DenseParameters {
 		model.DenseParameters[name] = common.DeserializeFromTensorProto(v)
@@ -82,7 +225,7 @@ func (model *Model) InitFromModelPB(pb *proto.Model) error {
 		}
 	}
 	if pb.Version >= 1 {
-		model.Version = pb.Version
+		atomic.StoreInt32(&model.Version, pb.Version)
 	}
 	return nil
 }
@@ -90,19 +233,30 @@ func (model *Model) InitFromModelPB(pb *proto.Model) error {
 // SaveToModelPB saves in-memory model to PB
 func (model *Model) SaveToModelPB() *proto.Model {
 	var modelPB proto.Model
-	modelPB.Version = model.Version
+	modelPB.Version = model.GetVersion()
 	modelPB.DenseParameters = make(map[string]*tensor_go_proto.TensorProto)
 	for name, v := range model.DenseParameters {
-		modelPB.DenseParameters[name] = v.SerializeToTensorProto()
+		unlock := model.rLockParameter(name)
+		modelPB.DenseParameters[name] = v.Clone().SerializeToTensorProto()
+		unlock()
 	}
 	modelPB.EmbeddingTables = make(map[string]*proto.IndexedSlicesProto)
 	for name, v := range model.EmbeddingTables {
+		unlock := model.rLockParameter(name)
 		modelPB.EmbeddingTables[name] = v.ToIndexedSlices().SerializeToIndexedSlicesProto()
+		unlock()
 		info := proto.EmbeddingTableInfo{
-			Name:        name,
-			Dim:         v.Dim,
-			Initializer: v.Initializer,
-			Dtype:       v.Dtype,
+			Name:                 name,
+			Dim:                  v.Dim,
+			Initializer:          v.Initializer,
+			Dtype:                v.Dtype,
+			MaxRows:              v.MaxRows,
+			Ttl:                  v.TTL,
+			AdmissionThreshold:   v.AdmissionThreshold,
+			AdmissionSketchWidth: v.AdmissionSketchWidth,
+			CacheRows:            v.CacheRows,
+			StorageDtype:         v.StorageDtype,
+			KeyType:              v.KeyType,
 		}
 		modelPB.EmbeddingTableInfos = append(modelPB.EmbeddingTableInfos, &info)
 	}
@@ -14,6 +14,9 @@
 package ps
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"elasticdl.org/elasticdl/pkg/common"
@@ -41,6 +44,15 @@ func TestModelInit(t *testing.T) {
 	assert.Equal(t, model.GetDenseParameter("t1").Dims, d1)
 	assert.Equal(t, model.GetDenseParameter("t2").Dims, d2)
 	assert.Nil(t, model.GetDenseParameter("t3"))
+
+	err := model.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e1", Dim: 4, Initializer: "uniform", Dtype: common.Float32})
+	assert.Nil(t, err)
+	err = model.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e2", Dim: 4, Initializer: "uniform", Dtype: common.Float32})
+	assert.Nil(t, err)
+	assert.NotEqual(t, model.GetEmbeddingTable("e1").Seed, model.GetEmbeddingTable("e2").Seed)
+	err = model.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e3", Dim: 4, Initializer: "unknown", Dtype: common.Float32})
+	assert.NotNil(t, err)
+	assert.Nil(t, model.GetEmbeddingTable("e3"))
 }
 
 func TestModelInitFrom(t *testing.T) {
@@ -78,7 +90,7 @@ func TestModelInitFrom(t *testing.T) {
 
 	e1 := model.GetEmbeddingTable("e1")
 	assert.Equal(t, int64(2), e1.Dim)
-	assert.Equal(t, 3, len(e1.EmbeddingVectors))
+	assert.Equal(t, 3, e1.Len())
 
 	ev1 := e1.GetEmbeddingVector(1)
 	assert.True(t, common.CompareFloatArray([]float32{1.0, 2.0}, common.Slice(ev1).([]float32), 0.0001))
@@ -100,7 +112,7 @@ func TestModelSaveToPB(t *testing.T) {
 	i1 := []int64{1, 3, 5}
 	is := common.NewIndexedSlices(t1, i1)
 
-	model.EmbeddingTables["e1"] = common.NewEmbeddingTable(2, "zero", common.Float32)
+	assert.Nil(t, model.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}))
 	model.EmbeddingTables["e1"].SetEmbeddingVectors(is)
 
 	modelPB := model.SaveToModelPB()
@@ -117,3 +129,46 @@ func TestModelSaveToPB(t *testing.T) {
 			common.Slice(rev).([]float32), 0.0001))
 	}
 }
+
+func TestModelEmbeddingDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "model_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	model := NewModel()
+	model.EmbeddingDiskDir = dir
+	info := &proto.EmbeddingTableInfo{
+		Name:        "layer/embeddings:0",
+		Dim:         2,
+		Initializer: "zero",
+		Dtype:       common.Float32,
+		CacheRows:   100,
+	}
+	assert.Nil(t, model.SetEmbeddingTableInfo(info))
+	defer model.GetEmbeddingTable(info.Name).Close()
+	_, err = os.Stat(filepath.Join(dir, "layer%2Fembeddings:0", "shard-0"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), model.SaveToModelPB().EmbeddingTableInfos[0].CacheRows)
+}
+
+func TestModelEmbeddingTableDefaults(t *testing.T) {
+	model := NewModel()
+	model.EmbeddingTableDefaults = &proto.EmbeddingTableInfo{MaxRows: 100, Ttl: 5, AdmissionThreshold: 3,
+		AdmissionSketchWidth: 64}
+	info := &proto.EmbeddingTableInfo{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}
+	assert.Nil(t, model.SetEmbeddingTableInfo(info))
+	assert.Equal(t, int32(3), info.AdmissionThreshold)
+	assert.Equal(t, int64(100), info.MaxRows)
+	assert.Equal(t, int64(100), model.GetEmbeddingTable("e1").MaxRows)
+	assert.Equal(t, int32(5), model.GetEmbeddingTable("e1").TTL)
+	assert.Equal(t, int32(3), model.GetEmbeddingTable("e1").AdmissionThreshold)
+	assert.Equal(t, int64(64), model.GetEmbeddingTable("e1").AdmissionSketchWidth)
+
+	// tables which set a policy keep it
+	info = &proto.EmbeddingTableInfo{Name: "e2", Dim: 2, Initializer: "zero", Dtype: common.Float32, AdmissionThreshold: 2,
+		MaxRows: 10}
+	assert.Nil(t, model.SetEmbeddingTableInfo(info))
+	assert.Equal(t, int32(2), model.GetEmbeddingTable("e2").AdmissionThreshold)
+	assert.Equal(t, int64(10), model.GetEmbeddingTable("e2").MaxRows)
+	saved := model.SaveToModelPB().EmbeddingTableInfos
+	assert.Equal(t, int64(64), saved[0].AdmissionSketchWidth)
+}
@@ -14,60 +14,268 @@
 package ps
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"elasticdl.org/elasticdl/pkg/common"
 	"elasticdl.org/elasticdl/pkg/kernel"
 	"elasticdl.org/elasticdl/pkg/proto"
+	"elasticdl.org/elasticdl/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Optimizer interface
 type Optimizer interface {
 	GetLR() float32
-	InitOptimizer(*proto.Model)
-	ApplyGradients(*proto.Model, *Model, float32) error
+	InitOptimizer(*proto.Model) error
+	ApplyGradients(context.Context, *proto.Model, *Model, float32) error
+	SetParallelism(int)
+	SetEmbeddingDiskDir(string)
+	RemoveEmbeddingRows(string, []int64)
+	MoveEmbeddingRowsToDisk(string, []int64) error
+	GetStep() int64
+	Close() error
 }
 
+// minRowsPerPartition is the minimum number of gradient rows in a partition
+// of a sparse gradient, smaller gradients are not worth splitting
+const minRowsPerPartition = 256
+
 // BaseOptimizer struct
 type BaseOptimizer struct {
 	lr            float32
 	step          int64
-	DenseKernel   func(*common.Tensor, *common.Tensor, string, float32)
-	SparseKernel  func(*common.IndexedSlices, *common.EmbeddingTable, string, float32) error
-	IndexedKernel func(*common.IndexedSlices, *common.Tensor, string, float32) error
+	parallelism   int // 0 means the number of CPUs
+	DenseKernel   func(*common.Tensor, *common.Tensor, string, float32, int64)
+	SparseKernel  func(*common.IndexedSlices, *common.EmbeddingTable, string, float32, int64) error
+	IndexedKernel func(*common.IndexedSlices, *common.Tensor, string, float32, int64) error
+	slots         []*Model
 }
 
-// ApplyGradients base method
-func (opt *BaseOptimizer) ApplyGradients(grads *proto.Model, model *Model, lr float32) error {
-	opt.step++
+// ApplyGradients base method. Rows of duplicated ids in a sparse gradient are
+// summed up first, so that each row gets exactly one optimizer step per push.
+// Dense parameters and partitions of sparse gradients are applied in parallel.
+// Sparse gradients are partitioned by id, so a row is always updated by one
+// goroutine and the result does not depend on scheduling. All parameters in grads
+// are locked while they are updated, for read in Hogwild mode, see lockParameters.
+// Waiting for the locks, deserializing and applying the kernel to each part of
+// a parameter are traced as child spans of the span in ctx.
+func (opt *BaseOptimizer) ApplyGradients(ctx context.Context, grads *proto.Model, model *Model, lr float32) error {
+	names := make([]string, 0, len(grads.DenseParameters)+len(grads.EmbeddingTables))
+	for name := range grads.DenseParameters {
+		names = append(names, name)
+	}
+	for name := range grads.EmbeddingTables {
+		names = append(names, name)
+	}
+	_, span := tracing.Start(ctx, "lockParameters")
+	unlock := model.lockParameters(names)
+	span.End()
+	defer unlock()
+	step := atomic.AddInt64(&opt.step, 1)
+	var tasks []func() error
 	for name, tensorPB := range grads.DenseParameters {
+		_, span := tracing.Start(ctx, "DeserializeFromTensorProto", attribute.String("parameter", name))
 		grad := common.DeserializeFromTensorProto(tensorPB)
+		span.End()
 		param := model.GetDenseParameter(name)
 		if param == nil {
 			return fmt.Errorf("grad %s not in Parameter", name)
 		}
-		opt.DenseKernel(grad, param, name, lr)
+		name := name
+		tasks = append(tasks, func() error {
+			_, span := tracing.Start(ctx, "DenseKernel", attribute.String("parameter", name))
+			opt.DenseKernel(grad, param, name, lr, step)
+			span.End()
+			return nil
+		})
 	}
 	for name, indexedSlicePB := range grads.EmbeddingTables {
+		_, span := tracing.Start(ctx, "DeserializeFromIndexedSliceProto", attribute.String("parameter", name))
 		grad := common.DeserializeFromIndexedSliceProto(indexedSlicePB)
+		span.End()
+		name := name
 		param := model.GetDenseParameter(name)
+		table := model.GetEmbeddingTable(name)
+		if param == nil && table != nil {
+			var err error
+			if grad, err = table.ResolveKeys(grad); err != nil {
+				return fmt.Errorf("grad %s: %v", name, err)
+			}
+		}
+		grad, err := common.DeduplicateIndexedSlices(grad)
+		if err != nil {
+			return err
+		}
 		if param == nil {
-			table := model.GetEmbeddingTable(name)
 			if table == nil {
 				return fmt.Errorf("grad %s not in Parameter", name)
 			}
-			err := opt.SparseKernel(grad, table, name, lr)
-			if err != nil {
-				return err
+			table.RecordPush()
+			if grad = table.FilterAdmittedRows(grad); len(grad.Ids) == 0 {
+				continue
+			}
+			for _, part := range partitionIndexedSlices(grad, opt.numThreads()) {
+				part := part
+				tasks = append(tasks, func() error {
+					_, span := tracing.Start(ctx, "SparseKernel",
+						attribute.String("parameter", name), attribute.Int("rows", len(part.Ids)))
+					err := opt.SparseKernel(part, table, name, lr, step)
+					tracing.End(span, err)
+					return err
+				})
 			}
 		} else {
-			err := opt.IndexedKernel(grad, param, name, lr)
-			if err != nil {
+			for _, part := range partitionIndexedSlices(grad, opt.numThreads()) {
+				part := part
+				tasks = append(tasks, func() error {
+					_, span := tracing.Start(ctx, "IndexedKernel",
+						attribute.String("parameter", name), attribute.Int("rows", len(part.Ids)))
+					err := opt.IndexedKernel(part, param, name, lr, step)
+					tracing.End(span, err)
+					return err
+				})
+			}
+		}
+	}
+	return runTasks(tasks, opt.numThreads())
+}
+
+// GetStep returns the number of optimizer steps
+func (opt *BaseOptimizer) GetStep() int64 {
+	return atomic.LoadInt64(&opt.step)
+}
+
+// SetParallelism sets the number of goroutines to apply gradients, 0 means the number of CPUs
+func (opt *BaseOptimizer) SetParallelism(parallelism int) {
+	opt.parallelism = parallelism
+}
+
+// numThreads returns the number of goroutines to apply gradients
+func (opt *BaseOptimizer) numThreads() int {
+	if opt.parallelism <= 0 {
+		return runtime.NumCPU()
+	}
+	return opt.parallelism
+}
+
+// partitionIndexedSlices splits a sparse gradient into at most num parts by id.
+// The gradient is deduplicated, so parts have different ids, and kernels applying
+// them in parallel never update the same row.
+func partitionIndexedSlices(grad *common.IndexedSlices, num int) []*common.IndexedSlices {
+	if maxNum := len(grad.Ids) / minRowsPerPartition; num > maxNum {
+		num = maxNum
+	}
+	if num <= 1 {
+		return []*common.IndexedSlices{grad}
+	}
+	rows := make([][]int64, num)
+	for i, id := range grad.Ids {
+		p := int(common.HashID(id) % uint64(num))
+		rows[p] = append(rows[p], int64(i))
+	}
+	width := grad.ConcatTensors.Dims[1]
+	dtype := grad.ConcatTensors.Dtype
+	parts := make([]*common.IndexedSlices, 0, num)
+	for _, r := range rows {
+		if len(r) == 0 {
+			continue
+		}
+		tensor := common.NewEmptyTensor([]int64{int64(len(r)), width}, dtype)
+		ids := make([]int64, len(r))
+		for i, row := range r {
+			tensor.SetRow(int64(i), grad.ConcatTensors.GetRow(row))
+			ids[i] = grad.Ids[row]
+		}
+		parts = append(parts, common.NewIndexedSlices(tensor, ids))
+	}
+	return parts
+}
+
+// runTasks runs tasks with at most parallelism goroutines and returns the
+// error of the first failed task in task order
+func runTasks(tasks []func() error, parallelism int) error {
+	if parallelism <= 1 || len(tasks) <= 1 {
+		for _, task := range tasks {
+			if err := task(); err != nil {
 				return err
 			}
 		}
+		return nil
+	}
+	if parallelism > len(tasks) {
+		parallelism = len(tasks)
+	}
+	errs := make([]error, len(tasks))
+	taskCh := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range taskCh {
+				errs[i] = tasks[i]()
+			}
+		}()
+	}
+	for i := range tasks {
+		taskCh <- i
+	}
+	close(taskCh)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveEmbeddingRows frees the optimizer slots of removed embedding rows
+func (opt *BaseOptimizer) RemoveEmbeddingRows(name string, ids []int64) {
+	for _, slots := range opt.slots {
+		if table := slots.GetEmbeddingTable(name); table != nil {
+			table.RemoveEmbeddingVectors(ids)
+		}
+	}
+}
+
+// MoveEmbeddingRowsToDisk moves the optimizer slots of embedding rows moved to disk
+func (opt *BaseOptimizer) MoveEmbeddingRowsToDisk(name string, ids []int64) error {
+	for _, slots := range opt.slots {
+		if table := slots.GetEmbeddingTable(name); table != nil {
+			if err := table.MoveRowsToDisk(ids); err != nil {
+				return fmt.Errorf("Optimizer slots of embedding table %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SetEmbeddingDiskDir sets the directory of slot tables with disk storage. It is
+// called before InitOptimizer. Each slot is kept in its own subdirectory of
+// dir/.optimizer, the files of embedding tables are in dir, see Model.
+func (opt *BaseOptimizer) SetEmbeddingDiskDir(dir string) {
+	if dir == "" {
+		return
+	}
+	for i, slots := range opt.slots {
+		slots.EmbeddingDiskDir = filepath.Join(dir, ".optimizer", strconv.Itoa(i))
+	}
+}
+
+// Close closes the disk storage of slot tables
+func (opt *BaseOptimizer) Close() error {
+	for _, slots := range opt.slots {
+		if err := slots.Close(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -77,6 +285,23 @@ func (opt *BaseOptimizer) GetLR() float32 {
 	return opt.lr
 }
 
+// setSlotTableInfo creates the slot table of an embedding table, slots are initialized with zeros.
+// Slots are stored in the dtype of the embedding table even if its rows are quantized, as small
+// moments would be rounded to zero. The slot table does not evict rows by itself, but follows the
+// rows of the embedding table evicted or moved to disk, see RemoveEmbeddingRows and
+// MoveEmbeddingRowsToDisk.
+func setSlotTableInfo(slots *Model, info *proto.EmbeddingTableInfo) error {
+	return slots.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{
+		Name:        info.Name,
+		Dim:         info.Dim,
+		Initializer: "zeros",
+		Dtype:       info.Dtype,
+		MaxRows:     info.MaxRows,
+		Ttl:         info.Ttl,
+		CacheRows:   info.CacheRows,
+	})
+}
+
 // SGDOptimizer struct
 type SGDOptimizer struct {
 	BaseOptimizer
@@ -89,21 +314,21 @@ func NewSGDOptimizer(lr float32) *SGDOptimizer {
 			lr: lr,
 		},
 	}
-	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32) {
+	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32, step int64) {
 		kernel.SGD(grad, param, lr)
 	}
-	opt.SparseKernel = func(grad *common.IndexedSlices, param *common.EmbeddingTable, name string, lr float32) error {
+	opt.SparseKernel = func(grad *common.IndexedSlices, param *common.EmbeddingTable, name string, lr float32, step int64) error {
 		return kernel.SparseSGD(grad, param, lr)
 	}
-	opt.IndexedKernel = func(grad *common.IndexedSlices, param *common.Tensor, name string, lr float32) error {
+	opt.IndexedKernel = func(grad *common.IndexedSlices, param *common.Tensor, name string, lr float32, step int64) error {
 		return kernel.IndexedSGD(grad, param, lr)
 	}
 	return &opt
 }
 
 // InitOptimizer SGD Nothing to Init
-func (opt *SGDOptimizer) InitOptimizer(pb *proto.Model) {
-	return
+func (opt *SGDOptimizer) InitOptimizer(pb *proto.Model) error {
+	return nil
 }
 
 // MomentumOptimizer struct
@@ -124,17 +349,18 @@ func NewMomentumOptimizer(lr float32, mu float32, nesterov bool) *MomentumOptimi
 		nesterov: nesterov,
 		v:        NewModel(),
 	}
-	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32) {
+	opt.slots = []*Model{opt.v}
+	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32, step int64) {
 		v := opt.v.GetDenseParameter(name)
 		kernel.Momentum(grad, param, v, opt.mu, opt.nesterov, lr)
 	}
 	opt.SparseKernel = func(grad *common.IndexedSlices, param *common.EmbeddingTable, name string,
-		lr float32) error {
+		lr float32, step int64) error {
 		v := opt.v.GetEmbeddingTable(name)
 		return kernel.SparseMomentum(grad, param, v, opt.mu, opt.nesterov, lr)
 	}
 	opt.IndexedKernel = func(grad *common.IndexedSlices, param *common.Tensor, name string,
-		lr float32) error {
+		lr float32, step int64) error {
 		v := opt.v.GetDenseParameter(name)
 		return kernel.IndexedMomentum(grad, param, v, opt.mu, opt.nesterov, lr)
 	}
@@ -142,15 +368,18 @@ func NewMomentumOptimizer(lr float32, mu float32, nesterov bool) *MomentumOptimi
 }
 
 // InitOptimizer set v non-embedding of MomentumOptimizer
-func (opt *MomentumOptimizer) InitOptimizer(pb *proto.Model) {
+func (opt *MomentumOptimizer) InitOptimizer(pb *proto.Model) error {
 	for name, tensor := range pb.DenseParameters {
 		dims := common.GetDimFromTensorProto(tensor)
 		dtype := tensor.Dtype
 		opt.v.DenseParameters[name] = common.NewEmptyTensor(dims, dtype)
 	}
 	for _, info := range pb.EmbeddingTableInfos {
-		opt.v.SetEmbeddingTableInfo(info)
+		if err := setSlotTableInfo(opt.v, info); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 // AdamOptimizer struct
@@ -180,46 +409,47 @@ func NewAdamOptimizer(lr float32, beta1 float32, beta2 float32, epsilon float32,
 		v:         NewModel(),
 		maxSquare: NewModel(),
 	}
-	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32) {
+	opt.slots = []*Model{opt.m, opt.v, opt.maxSquare}
+	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32, step int64) {
 		m := opt.m.GetDenseParameter(name)
 		v := opt.v.GetDenseParameter(name)
 		if opt.amsgrad {
 			ms := opt.maxSquare.GetDenseParameter(name)
-			kernel.Adam(grad, param, m, v, lr, opt.step,
+			kernel.Adam(grad, param, m, v, lr, step,
 				opt.beta1, opt.beta2, opt.epsilon, true, ms)
 		}
-		kernel.Adam(grad, param, m, v, lr, opt.step,
+		kernel.Adam(grad, param, m, v, lr, step,
 			opt.beta1, opt.beta2, opt.epsilon, false, nil)
 	}
 	opt.SparseKernel = func(grad *common.IndexedSlices, param *common.EmbeddingTable, name string,
-		lr float32) error {
+		lr float32, step int64) error {
 		m := opt.m.GetEmbeddingTable(name)
 		v := opt.v.GetEmbeddingTable(name)
 		if opt.amsgrad {
 			ms := opt.maxSquare.GetEmbeddingTable(name)
-			return kernel.SparseAdam(grad, param, m, v, lr, opt.step,
+			return kernel.SparseAdam(grad, param, m, v, lr, step,
 				opt.beta1, opt.beta2, opt.epsilon, true, ms)
 		}
-		return kernel.SparseAdam(grad, param, m, v, lr, opt.step,
+		return kernel.SparseAdam(grad, param, m, v, lr, step,
 			opt.beta1, opt.beta2, opt.epsilon, false, nil)
 	}
 	opt.IndexedKernel = func(grad *common.IndexedSlices, param *common.Tensor, name string,
-		lr float32) error {
+		lr float32, step int64) error {
 		m := opt.m.GetDenseParameter(name)
 		v := opt.v.GetDenseParameter(name)
 		if opt.amsgrad {
 			ms := opt.maxSquare.GetDenseParameter(name)
-			return kernel.IndexedAdam(grad, param, m, v, lr, opt.step,
+			return kernel.IndexedAdam(grad, param, m, v, lr, step,
 				opt.beta1, opt.beta2, opt.epsilon, true, ms)
 		}
-		return kernel.IndexedAdam(grad, param, m, v, lr, opt.step,
+		return kernel.IndexedAdam(grad, param, m, v, lr, step,
 			opt.beta1, opt.beta2, opt.epsilon, false, nil)
 	}
 	return &opt
 }
 
 // InitOptimizer set m,v,maxSquare non-embedding of AdamOptimizer
-func (opt *AdamOptimizer) InitOptimizer(pb *proto.Model) {
+func (opt *AdamOptimizer) InitOptimizer(pb *proto.Model) error {
 	for name, tensor := range pb.DenseParameters {
 		dims := common.GetDimFromTensorProto(tensor)
 		dtype := tensor.Dtype
@@ -230,10 +460,13 @@ func (opt *AdamOptimizer) InitOptimizer(pb *proto.Model) {
 		}
 	}
 	for _, info := range pb.EmbeddingTableInfos {
-		opt.m.SetEmbeddingTableInfo(info)
-		opt.v.SetEmbeddingTableInfo(info)
-		opt.maxSquare.SetEmbeddingTableInfo(info)
+		for _, slots := range opt.slots {
+			if err := setSlotTableInfo(slots, info); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 // AdagradOptimizer struct
@@ -252,17 +485,18 @@ func NewAdagradOptimizer(lr float32, epsilon float32) *AdagradOptimizer {
 		epsilon: epsilon,
 		m:       NewModel(),
 	}
-	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32) {
+	opt.slots = []*Model{opt.m}
+	opt.DenseKernel = func(grad *common.Tensor, param *common.Tensor, name string, lr float32, step int64) {
 		m := opt.m.GetDenseParameter(name)
 		kernel.Adagrad(grad, param, m, lr, opt.epsilon)
 	}
 	opt.SparseKernel = func(grad *common.IndexedSlices, param *common.EmbeddingTable,
-		name string, lr float32) error {
+		name string, lr float32, step int64) error {
 		m := opt.m.GetEmbeddingTable(name)
 		return kernel.SparseAdagrad(grad, param, m, lr, opt.epsilon)
 	}
 	opt.IndexedKernel = func(grad *common.IndexedSlices, param *common.Tensor,
-		name string, lr float32) error {
+		name string, lr float32, step int64) error {
 		m := opt.m.GetDenseParameter(name)
 		return kernel.IndexedAdagrad(grad, param, m, lr, opt.epsilon)
 	}
@@ -270,15 +504,18 @@ func NewAdagradOptimizer(lr float32, epsilon float32) *AdagradOptimizer {
 }
 
 // InitOptimizer set m, non-embedding of AdagradOptimizer
-func (opt *AdagradOptimizer) InitOptimizer(pb *proto.Model) {
+func (opt *AdagradOptimizer) InitOptimizer(pb *proto.Model) error {
 	for name, tensor := range pb.DenseParameters {
 		dims := common.GetDimFromTensorProto(tensor)
 		dtype := tensor.Dtype
 		opt.m.DenseParameters[name] = common.NewEmptyTensor(dims, dtype)
 	}
 	for _, info := range pb.EmbeddingTableInfos {
-		opt.m.SetEmbeddingTableInfo(info)
+		if err := setSlotTableInfo(opt.m, info); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 const (
@@ -302,6 +539,9 @@ var optArgumentsMap = map[string][]string{
 
 // parseOptArgs parses optimizer arguments according to optimizer type
 func parseOptArgs(optType string, optArgs string) (map[string]string, error) {
+	if _, ok := optArgumentsMap[optType]; !ok {
+		return nil, fmt.Errorf("Unknown optimizer type %s", optType)
+	}
 	// parse arguments to map
 	argsMap := make(map[string]string)
 	for _, args := range strings.Split(optArgs, ";") {
@@ -309,6 +549,9 @@ func parseOptArgs(optType string, optArgs string) (map[string]string, error) {
 			continue
 		} else {
 			arr := strings.Split(args, "=")
+			if len(arr) != 2 {
+				return nil, fmt.Errorf("Args passed to ps should be name=value: %s", args)
+			}
 			argsMap[arr[0]] = arr[1]
 		}
 	}
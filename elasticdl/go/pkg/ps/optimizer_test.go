@@ -14,6 +14,9 @@
 package ps
 
 import (
+	"context"
+	"math/rand"
+	"runtime"
 	"testing"
 
 	"elasticdl.org/elasticdl/pkg/common"
@@ -46,7 +49,7 @@ func TestSGDOptimizer(t *testing.T) {
 	opt := NewSGDOptimizer(0.1)
 
 	// test dense parameter update
-	err1 := opt.ApplyGradients(pbModel, model, float32(0.5)*opt.GetLR())
+	err1 := opt.ApplyGradients(context.Background(), pbModel, model, float32(0.5)*opt.GetLR())
 	assert.Equal(t, opt.GetLR(), float32(0.1))
 	assert.Nil(t, err1)
 
@@ -61,7 +64,7 @@ func TestSGDOptimizer(t *testing.T) {
 	pbModel = &proto.Model{
 		DenseParameters: map[string]*tensor_go_proto.TensorProto{"t3": grad3.SerializeToTensorProto()},
 	}
-	err2 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err2 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.NotNil(t, err2)
 
 	// test sparse parameter update
@@ -84,7 +87,7 @@ func TestSGDOptimizer(t *testing.T) {
 		EmbeddingTables: map[string]*proto.IndexedSlicesProto{"t3": sgrad3.SerializeToIndexedSlicesProto()},
 	}
 
-	err3 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err3 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.Nil(t, err3)
 
 	ev1 = []float32{0.85, 1.85, 2.85, 3.85, 4.85, 5.85}
@@ -107,7 +110,7 @@ func TestSGDOptimizer(t *testing.T) {
 		EmbeddingTables: map[string]*proto.IndexedSlicesProto{"t3": sgrad3.SerializeToIndexedSlicesProto()},
 	}
 
-	err4 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err4 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.Nil(t, err4)
 
 	vectors = model.GetEmbeddingTable("t3").GetEmbeddingVectors([]int64{1, 3, 5})
@@ -145,11 +148,11 @@ func TestAdamOptimizer(t *testing.T) {
 	}
 
 	opt := NewAdamOptimizer(0.1, 0.9, 0.999, 1e-8, false)
-	opt.InitOptimizer(pbModel)
+	assert.Nil(t, opt.InitOptimizer(pbModel))
 	opt.step = 1
 
 	// test dense parameter update
-	err1 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err1 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.Equal(t, opt.GetLR(), float32(0.1))
 	assert.Nil(t, err1)
 
@@ -164,7 +167,7 @@ func TestAdamOptimizer(t *testing.T) {
 	pbModel = &proto.Model{
 		DenseParameters: map[string]*tensor_go_proto.TensorProto{"t3": grad3.SerializeToTensorProto()},
 	}
-	err2 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err2 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.NotNil(t, err2)
 
 	// test sparse parameter update
@@ -187,7 +190,7 @@ func TestAdamOptimizer(t *testing.T) {
 		EmbeddingTables: map[string]*proto.IndexedSlicesProto{"t3": sgrad3.SerializeToIndexedSlicesProto()},
 	}
 
-	err3 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err3 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.Nil(t, err3)
 
 	ev1 = []float32{0.8474920307, 1.8474920307, 2.8474920307, 3.8474920307, 4.8474920307, 5.8474920307}
@@ -210,7 +213,7 @@ func TestAdamOptimizer(t *testing.T) {
 		EmbeddingTables: map[string]*proto.IndexedSlicesProto{"t3": sgrad3.SerializeToIndexedSlicesProto()},
 	}
 
-	err4 := opt.ApplyGradients(pbModel, model, float32(1.0)*opt.GetLR())
+	err4 := opt.ApplyGradients(context.Background(), pbModel, model, float32(1.0)*opt.GetLR())
 	assert.Nil(t, err4)
 
 	vectors = model.GetEmbeddingTable("t3").GetEmbeddingVectors([]int64{1, 3, 5})
@@ -241,6 +244,12 @@ func TestParseOptArgs(t *testing.T) {
 	argsMap, err = parseOptArgs(optType, optArgs)
 	assert.NotNil(t, err)
 
+	// should return error for malformed arguments and unknown optimizers
+	_, err = parseOptArgs("SGD", "learning_rate;momentum=0.0;nesterov=true;")
+	assert.NotNil(t, err)
+	_, err = parseOptArgs("RMSprop", "learning_rate=0.1;")
+	assert.NotNil(t, err)
+
 	// parse Adam optimizer arguments
 	optType = "Adam"
 	optArgs = "learning_rate=0.2;beta_1=0.5;beta_2=0.3;epsilon=0.005;amsgrad=false;"
@@ -282,3 +291,107 @@ func TestNewOptimizer(t *testing.T) {
 	assert.Equal(t, adagradOpt.GetLR(), float32(0.2))
 	assert.Equal(t, adagradOpt.epsilon, float32(0.005))
 }
+
+func TestParallelApplyGradients(t *testing.T) {
+	const rows int = 4000
+	const dim int64 = 4
+	info := &proto.EmbeddingTableInfo{
+		Name:        "e1",
+		Dim:         dim,
+		Initializer: "zero",
+		Dtype:       common.Float32,
+	}
+	dense := make([]float32, 10)
+	sparse := make([]float32, rows*int(dim))
+	ids := make([]int64, rows)
+	for i := range dense {
+		dense[i] = rand.Float32()
+	}
+	for i := range sparse {
+		sparse[i] = rand.Float32()
+	}
+	for i := range ids {
+		ids[i] = rand.Int63n(int64(rows / 2))
+	}
+	grads := &proto.Model{
+		DenseParameters: map[string]*tensor_go_proto.TensorProto{
+			"t1": common.NewTensor(dense, []int64{2, 5}).SerializeToTensorProto(),
+		},
+		EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+			"e1": common.NewIndexedSlices(common.NewTensor(sparse, []int64{int64(rows), dim}), ids).SerializeToIndexedSlicesProto(),
+		},
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{info},
+	}
+
+	apply := func(parallelism int) *Model {
+		model := NewModel()
+		model.DenseParameters["t1"] = common.NewEmptyTensor([]int64{2, 5}, common.Float32)
+		model.SetEmbeddingTableInfo(info)
+		opt := NewAdamOptimizer(0.1, 0.9, 0.999, 1e-8, false)
+		assert.Nil(t, opt.InitOptimizer(grads))
+		opt.SetParallelism(parallelism)
+		for i := 0; i < 3; i++ {
+			assert.Nil(t, opt.ApplyGradients(context.Background(), grads, model, opt.GetLR()))
+		}
+		return model
+	}
+
+	// optimizers use all CPUs unless set otherwise
+	opt := NewSGDOptimizer(0.1)
+	assert.Equal(t, runtime.NumCPU(), opt.numThreads())
+	opt.SetParallelism(2)
+	assert.Equal(t, 2, opt.numThreads())
+
+	expected := apply(1)
+	actual := apply(8)
+	assert.Equal(t, common.Slice(expected.GetDenseParameter("t1")), common.Slice(actual.GetDenseParameter("t1")))
+	assert.Equal(t, expected.GetEmbeddingTable("e1").Len(), actual.GetEmbeddingTable("e1").Len())
+	expectedRows := expected.GetEmbeddingTable("e1").ToIndexedSlices()
+	for i, id := range expectedRows.Ids {
+		assert.Equal(t, common.Slice(expectedRows.ConcatTensors.GetRow(int64(i))), common.Slice(actual.GetEmbeddingTable("e1").GetEmbeddingVector(id)))
+	}
+}
+
+func TestPartitionIndexedSlices(t *testing.T) {
+	// ids of a PS of 4 pods are all 1 modulo 4, they are still spread over 8 parts
+	const num int = 8
+	const rows int = 4 * num * minRowsPerPartition
+	ids := make([]int64, rows)
+	for i := range ids {
+		ids[i] = int64(i)*4 + 1
+	}
+	grad := common.NewIndexedSlices(common.NewEmptyTensor([]int64{int64(rows), 2}, common.Float32), ids)
+	parts := partitionIndexedSlices(grad, num)
+	assert.Len(t, parts, num)
+	total := 0
+	for _, part := range parts {
+		assert.InDelta(t, rows/num, len(part.Ids), float64(rows/num)/5)
+		total += len(part.Ids)
+	}
+	assert.Equal(t, rows, total)
+}
+
+func TestDuplicatedSparseGradients(t *testing.T) {
+	info := &proto.EmbeddingTableInfo{
+		Name:        "e1",
+		Dim:         2,
+		Initializer: "zero",
+		Dtype:       common.Float32,
+	}
+	apply := func(grad *common.IndexedSlices) []float32 {
+		model := NewModel()
+		model.SetEmbeddingTableInfo(info)
+		pbModel := &proto.Model{
+			EmbeddingTables:     map[string]*proto.IndexedSlicesProto{"e1": grad.SerializeToIndexedSlicesProto()},
+			EmbeddingTableInfos: []*proto.EmbeddingTableInfo{info},
+		}
+		opt := NewAdamOptimizer(0.1, 0.9, 0.999, 1e-8, false)
+		assert.Nil(t, opt.InitOptimizer(pbModel))
+		assert.Nil(t, opt.ApplyGradients(context.Background(), pbModel, model, opt.GetLR()))
+		return common.Slice(model.GetEmbeddingTable("e1").GetEmbeddingVector(7)).([]float32)
+	}
+
+	duplicated := common.NewIndexedSlices(common.NewTensor([]float32{1.0, 2.0, 3.0, 4.0}, []int64{2, 2}), []int64{7, 7})
+	summed := common.NewIndexedSlices(common.NewTensor([]float32{4.0, 6.0}, []int64{1, 2}), []int64{7})
+	assert.True(t, common.CompareFloatArray(apply(summed), apply(duplicated), 0.00001))
+}
@@ -16,16 +16,25 @@ package ps
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"elasticdl.org/elasticdl/pkg/common"
 	"elasticdl.org/elasticdl/pkg/proto"
+	"elasticdl.org/elasticdl/pkg/tracing"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/tensor_go_proto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 const (
@@ -33,23 +42,6 @@ const (
 	maxReceiveMessageLength = 256 * 1024 * 1024
 )
 
-// MasterClient contains attributes to call master GRPC services
-type MasterClient struct {
-	client     proto.MasterClient
-	context    context.Context
-	clientConn *grpc.ClientConn
-}
-
-func (c *MasterClient) reportVersion(modelVersion int32) {
-	var request proto.ReportVersionRequest
-	request.ModelVersion = modelVersion
-	c.client.ReportVersion(c.context, &request)
-}
-
-func (c *MasterClient) closeConn() {
-	c.clientConn.Close()
-}
-
 // Server defines servicer of ps
 type Server struct {
 	proto.UnimplementedPserverServer
@@ -63,121 +55,212 @@ type Server struct {
 	keepCheckpointMax     int
 	numPsPods             int
 	lrStalenessModulation bool
-	ID                    int // a zero-based successive integer number
-	lock                  sync.Mutex
+	ID                    int          // a zero-based successive integer number
+	lock                  sync.RWMutex // held for write while the model structure changes
 	versionLock           sync.Mutex
 	savedCheckpointDirs   []string
+	metrics               *serverMetrics
+	health                *health.Server
+	ready                 int32 // 1 once the model is initialized
+	logger                *slog.Logger
+	errLock               sync.Mutex
+	err                   error
+	grpcServer            *grpc.Server
+	addr                  net.Addr
+	advertiseAddr         string
+	heartbeatInterval     time.Duration
+	inflight              inflightRPCs // RPCs in flight, their oldest age is reported in heartbeats
 }
 
-func createMasterClient(masterAddr string) *MasterClient {
-	if masterAddr == "" {
-		return nil
+// NewServer creates a Server instance configured by opts. It connects to the master
+// if there is a master address.
+func NewServer(opts ...ServerOption) (*Server, error) {
+	config := newServerConfig(opts)
+	var ps Server
+	ps.logger = config.Logger.With("ps_id", config.ID)
+	ps.Model = NewModel()
+	ps.Model.EmbeddingDiskDir = config.EmbeddingDiskDir
+	ps.Model.EmbeddingTableDefaults = config.EmbeddingDefaults
+
+	var err error
+	ps.Opt, err = NewOptimizer(config.OptType, config.OptArgs)
+	if err != nil {
+		return nil, err
 	}
-	conn, err := grpc.Dial(masterAddr, grpc.WithInsecure(), grpc.WithBlock())
+	ps.Opt.SetParallelism(config.NumGradThreads)
+	ps.Opt.SetEmbeddingDiskDir(config.EmbeddingDiskDir)
+	ps.Model.Hogwild = config.Hogwild
+	ps.ID = config.ID
+	ps.evaluationStep = config.EvaluationStep
+	ps.checkpointDirForInit = config.CheckpointDirForInit
+	ps.checkpointDir = config.CheckpointDir
+	ps.checkpointStep = config.CheckpointStep
+	ps.keepCheckpointMax = config.KeepCheckpointMax
+	ps.numPsPods = config.NumPsPods
+	ps.lrStalenessModulation = config.LRStalenessModulation
+	ps.advertiseAddr = config.AdvertiseAddr
+	ps.heartbeatInterval = config.HeartbeatInterval
+	ps.metrics = newServerMetrics(&ps)
+	ps.health = health.NewServer()
+	ps.setReady(false)
+	ps.masterClient, err = createMasterClient(config.MasterAddr, config.MasterDialTimeout,
+		config.MasterReportTimeout, ps.metrics, ps.logger)
 	if err != nil {
-		log.Fatalf("failed to connect to master: %v", err)
+		return nil, err
 	}
-	client := proto.NewMasterClient(conn)
-	return &MasterClient{
-		client:     client,
-		context:    context.Background(),
-		clientConn: conn,
+	return &ps, nil
+}
+
+// reportModelVersionIfNeeded queues the model version to be reported to the
+// master every evaluationStep versions, it does not wait for the report
+func (s *Server) reportModelVersionIfNeeded(ctx context.Context, modelVersion int) {
+	if s.evaluationStep > 0 && modelVersion%s.evaluationStep == 0 && s.masterClient != nil {
+		ctx, span := tracing.Start(ctx, "reportModelVersionIfNeeded", attribute.Int("version", modelVersion))
+		s.masterClient.reportVersionAsync(ctx, int32(modelVersion))
+		span.End()
 	}
 }
 
-// NewServer creates a Server instance
-func NewServer(ID int, optType string, optArgs string, masterAddr string,
-	evaluationStep int, checkpointDirForInit string,
-	checkpointDir string, checkpointStep int, keepCheckpointMax int, numPsPods int,
-	lrStalenessModulation bool) *Server {
-	var ps Server
-	if checkpointDirForInit != "" {
-		var err error
-		ps.Model, err = LoadModelFromCheckpoint(checkpointDirForInit, ID, numPsPods)
-		ps.Model.Initialized = true
+func (s *Server) saveCheckpointIfNeeded(ctx context.Context, modelVersion int) {
+	if s.checkpointDir != "" && s.checkpointStep != 0 && modelVersion%s.checkpointStep == 0 {
+		_, span := tracing.Start(ctx, "saveCheckpointIfNeeded", attribute.Int("version", modelVersion))
+		size, err := s.saveCheckpoint(modelVersion)
+		span.SetAttributes(attribute.Int("bytes", size))
+		tracing.End(span, err)
 		if err != nil {
-			log.Fatalf("failed to load from checkpoint: %v", err)
+			s.logger.Error("Failed to save the checkpoint", "model_version", modelVersion, "error", err)
 		}
-	} else {
-		ps.Model = NewModel()
 	}
+}
 
-	var err error
-	ps.Opt, err = NewOptimizer(optType, optArgs)
+// saveCheckpoint saves the model of modelVersion to checkpointDir, removes the
+// oldest checkpoint beyond keepCheckpointMax and returns the size. A checkpoint
+// which fails to save is not kept. The caller holds versionLock.
+func (s *Server) saveCheckpoint(modelVersion int) (int, error) {
+	checkpointVersionDir := path.Join(s.checkpointDir, fmt.Sprintf("version-%d", modelVersion))
+	start := time.Now()
+	size, err := SaveModelToCheckpoint(checkpointVersionDir, s.Model, s.ID, s.numPsPods)
 	if err != nil {
-		log.Fatalf("failed to create PS server: %v", err)
+		return 0, fmt.Errorf("Failed to save checkpoint %s: %v", checkpointVersionDir, err)
 	}
-	ps.ID = ID
-	ps.masterClient = createMasterClient(masterAddr)
-	ps.evaluationStep = evaluationStep
-	ps.checkpointDirForInit = checkpointDirForInit
-	ps.checkpointDir = checkpointDir
-	ps.checkpointStep = checkpointStep
-	ps.keepCheckpointMax = keepCheckpointMax
-	ps.numPsPods = numPsPods
-	ps.lrStalenessModulation = lrStalenessModulation
-	return &ps
-}
-
-func (s *Server) reportModelVersionIfNeeded(modelVersion int) {
-	if s.evaluationStep > 0 && modelVersion%s.evaluationStep == 0 && s.masterClient != nil {
-		s.masterClient.reportVersion(int32(modelVersion))
+	s.metrics.observeCheckpoint(time.Since(start), size)
+	s.savedCheckpointDirs = append(s.savedCheckpointDirs, checkpointVersionDir)
+	if s.ID == 0 {
+		if len(s.savedCheckpointDirs) > s.keepCheckpointMax {
+			deletedDir := s.savedCheckpointDirs[0]
+			s.savedCheckpointDirs = s.savedCheckpointDirs[1:]
+			os.RemoveAll(deletedDir)
+		}
 	}
+	return size, nil
 }
 
-func (s *Server) saveCheckpointIfNeeded(modelVersion int) {
-	if s.checkpointDir != "" && s.checkpointStep != 0 && modelVersion%s.checkpointStep == 0 {
-		checkpointVersionDir := path.Join(s.checkpointDir, fmt.Sprintf("version-%d", modelVersion))
-		s.savedCheckpointDirs = append(s.savedCheckpointDirs, checkpointVersionDir)
-		SaveModelToCheckpoint(checkpointVersionDir, s.Model, s.ID, s.numPsPods)
-		if s.ID == 0 {
-			if len(s.savedCheckpointDirs) > s.keepCheckpointMax {
-				deletedDir := s.savedCheckpointDirs[0]
-				s.savedCheckpointDirs = s.savedCheckpointDirs[1:]
-				os.RemoveAll(deletedDir)
+// evictEmbeddingRows evicts rows of embedding tables with an eviction policy
+// together with their optimizer slots
+func (s *Server) evictEmbeddingRows(version int32) {
+	for name, table := range s.Model.EmbeddingTables {
+		if !table.EvictionDue(version) {
+			continue
+		}
+		// locked for write even in Hogwild mode, as kernels write through views of the rows evicted,
+		// so only once eviction is due, and pushes do not wait for each other on other steps
+		unlock := s.Model.lockParametersExclusive([]string{name})
+		ids, moved, err := table.EvictRows(version)
+		if len(ids) > 0 {
+			s.Opt.RemoveEmbeddingRows(name, ids)
+		}
+		if len(moved) > 0 {
+			if slotErr := s.Opt.MoveEmbeddingRowsToDisk(name, moved); err == nil {
+				err = slotErr
 			}
 		}
+		unlock()
+		if err != nil {
+			s.logger.Error("Failed to move rows of embedding table to disk",
+				"table", name, "model_version", version, "error", err)
+		}
 	}
 }
 
 // PullDenseParameters pulls dense parameter from server
 func (s *Server) PullDenseParameters(ctx context.Context, in *proto.PullDenseParametersRequest) (*proto.PullDenseParametersResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if !s.Model.Initialized {
 		return &proto.PullDenseParametersResponse{Initialized: false}, nil
 	}
+	version := s.Model.GetVersion()
 	denseParamPB := make(map[string]*tensor_go_proto.TensorProto)
-	if s.Model.Version >= in.Version {
+	if version >= in.Version {
 		for name, tensor := range s.Model.DenseParameters {
-			denseParamPB[name] = tensor.SerializeToTensorProto()
+			unlock := s.Model.rLockParameter(name)
+			denseParamPB[name] = tensor.Clone().SerializeToTensorProto()
+			unlock()
 		}
 	}
 	var resp = proto.PullDenseParametersResponse{
 		Initialized:     true,
-		Version:         s.Model.Version,
+		Version:         version,
 		DenseParameters: denseParamPB,
 	}
 	return &resp, nil
 }
 
-// PullEmbeddingVectors pulls sparse parameter from server
+// PullEmbeddingVectors pulls sparse parameter from server. A read-only pull does not create rows for missing ids.
+// Tables with string keys are pulled by keys.
 func (s *Server) PullEmbeddingVectors(ctx context.Context, in *proto.PullEmbeddingVectorsRequest) (*tensor_go_proto.TensorProto, error) {
-	if in.Ids == nil {
+	if in.Ids == nil && in.Keys == nil {
 		return &tensor_go_proto.TensorProto{}, nil
 	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	table := s.Model.GetEmbeddingTable(in.Name)
 	if table == nil {
 		return &tensor_go_proto.TensorProto{}, fmt.Errorf("Request embedding Table %s not found in Param", in.Name)
 	}
-	t := table.GetEmbeddingVectors(in.Ids)
+	if (in.Keys != nil) != (table.KeyType == proto.EmbeddingKeyType_STRING_KEY) {
+		return &tensor_go_proto.TensorProto{}, fmt.Errorf("Embedding table %s has %v keys", in.Name, table.KeyType)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("table", in.Name),
+		attribute.Int("ids", len(in.Ids)+len(in.Keys)), attribute.Bool("compact", in.Compact))
+	_, span := tracing.Start(ctx, "rLockParameter")
+	unlock := s.Model.rLockParameter(in.Name)
+	span.End()
+	defer unlock()
+	ids := in.Ids
+	if in.Keys != nil {
+		if in.ReadOnly {
+			ids, _ = table.LookupKeyIDs(in.Keys)
+		} else {
+			ids, _ = table.KeyIDs(in.Keys)
+			defer table.ReleaseKeys(ids)
+		}
+	}
+	_, span = tracing.Start(ctx, "GetEmbeddingVectors")
+	defer span.End()
+	var t *common.Tensor
+	switch {
+	case in.ReadOnly:
+		t = table.LookupEmbeddingVectors(ids)
+	case in.Compact:
+		t = table.GetCompactEmbeddingVectors(ids)
+	default:
+		t = table.GetEmbeddingVectors(ids)
+	}
 	return t.SerializeToTensorProto(), nil
 }
 
 // PushGradients push gradients to server
 func (s *Server) PushGradients(ctx context.Context, in *proto.PushGradientsRequest) (*proto.PushGradientsResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	// TODO: only support async now
 	var lr = float32(1.0)
-	if s.lrStalenessModulation && s.Model.Version > in.Gradients.Version {
-		staleness := s.Model.Version - in.Gradients.Version
+	version := s.Model.GetVersion()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int("grad_version", int(in.Gradients.Version)),
+		attribute.Int("version", int(version)))
+	if s.lrStalenessModulation && version > in.Gradients.Version {
+		staleness := version - in.Gradients.Version
 		lr = lr / float32(staleness)
 	}
 	if in.LearningRate > 0.0 {
@@ -185,22 +268,24 @@ func (s *Server) PushGradients(ctx context.Context, in *proto.PushGradientsReque
 	} else {
 		lr = lr * s.Opt.GetLR()
 	}
-	err := s.Opt.ApplyGradients(in.Gradients, s.Model, lr)
+	err := s.Opt.ApplyGradients(ctx, in.Gradients, s.Model, lr)
+	s.metrics.observePush(err == nil, in.Gradients.Version, version)
 	if err != nil {
 		var resp = proto.PushGradientsResponse{
 			Accepted: false,
-			Version:  s.Model.Version,
+			Version:  s.Model.GetVersion(),
 		}
 		return &resp, err
 	}
 	s.versionLock.Lock()
-	s.Model.Version += int32(1)
-	s.saveCheckpointIfNeeded(int(s.Model.Version))
+	version = atomic.AddInt32(&s.Model.Version, 1)
+	s.saveCheckpointIfNeeded(ctx, int(version))
 	s.versionLock.Unlock()
-	s.reportModelVersionIfNeeded(int(s.Model.Version))
+	s.evictEmbeddingRows(version)
+	s.reportModelVersionIfNeeded(ctx, int(version))
 	var resp = proto.PushGradientsResponse{
 		Accepted: true,
-		Version:  s.Model.Version,
+		Version:  version,
 	}
 	return &resp, nil
 }
@@ -211,9 +296,12 @@ func (s *Server) PushModel(ctx context.Context, in *proto.Model) (*empty.Empty,
 	var err error
 	if !s.Model.Initialized {
 		err = s.Model.InitFromModelPB(in)
-		s.Opt.InitOptimizer(in)
+		if err == nil {
+			err = s.Opt.InitOptimizer(in)
+		}
 		if err == nil {
 			s.Model.Initialized = true
+			s.setReady(true)
 		}
 	}
 	s.lock.Unlock()
@@ -224,30 +312,186 @@ func (s *Server) PushModel(ctx context.Context, in *proto.Model) (*empty.Empty,
 func (s *Server) PushEmbeddingTableInfos(ctx context.Context, in *proto.Model) (*empty.Empty, error) {
 	s.lock.Lock()
 	err := s.Model.InitFromModelPB(in)
-	s.Opt.InitOptimizer(in)
+	if err == nil {
+		err = s.Opt.InitOptimizer(in)
+	}
 	s.lock.Unlock()
 	return &empty.Empty{}, err
 }
 
+// GetEmbeddingTableStats returns the statistics of embedding tables, sorted by name
+func (s *Server) GetEmbeddingTableStats(ctx context.Context, in *proto.GetEmbeddingTableStatsRequest) (*proto.GetEmbeddingTableStatsResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	names := in.Names
+	if len(names) == 0 {
+		for name := range s.Model.EmbeddingTables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var resp proto.GetEmbeddingTableStatsResponse
+	for _, name := range names {
+		table := s.Model.GetEmbeddingTable(name)
+		if table == nil {
+			return nil, fmt.Errorf("Embedding table %s not found", name)
+		}
+		stats := table.GetStats()
+		resp.Tables = append(resp.Tables, &proto.EmbeddingTableStats{
+			Name:               name,
+			Dim:                table.Dim,
+			Dtype:              table.Dtype,
+			Initializer:        table.Initializer,
+			Rows:               stats.Rows,
+			DiskRows:           stats.DiskRows,
+			MemoryBytes:        stats.MemoryBytes,
+			CreatedRows:        stats.CreatedRows,
+			Pulls:              stats.Pulls,
+			Pushes:             stats.Pushes,
+			AccessHistogram:    stats.AccessHistogram,
+			EvictedExpiredRows: stats.Eviction.Expired,
+			EvictedLruRows:     stats.Eviction.LeastRecentlyUsed,
+			KeyCollisions:      stats.KeyCollisions,
+		})
+	}
+	return &resp, nil
+}
+
 // Run creates a grpc server and starts the serving. Set serverDone when finishes.
-func (s *Server) Run(address string, concurrentStreams int, serverDone chan bool) *grpc.Server {
+// Each RPC is traced with a server span, see tracing.UnaryServerInterceptor, and logged by logInterceptor.
+// The model is restored from checkpointDirForInit in the background, RPCs to the PS
+// wait until it is restored, and the health service reports NOT_SERVING meanwhile.
+// If the model fails to be restored, the server stops and Err returns the error.
+// With a master and a heartbeat interval, the PS registers to it and sends heartbeats until
+// the connection closes.
+func (s *Server) Run(address string, concurrentStreams int, serverDone chan bool) (*grpc.Server, error) {
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
-		log.Fatalf("failed to start PS: %v", err)
+		return nil, fmt.Errorf("Failed to start PS at %s: %v", address, err)
 	}
 	grpcServer := grpc.NewServer(grpc.MaxRecvMsgSize(maxReceiveMessageLength),
 		grpc.MaxSendMsgSize(maxSendMessageLength),
-		grpc.MaxConcurrentStreams(uint32(concurrentStreams)))
+		grpc.MaxConcurrentStreams(uint32(concurrentStreams)),
+		grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor, s.logInterceptor, s.metrics.unaryInterceptor,
+			s.inflight.unaryInterceptor))
+	s.grpcServer = grpcServer
+	s.addr = lis.Addr()
 	proto.RegisterPserverServer(grpcServer, s)
-	go startServe(grpcServer, lis, serverDone, s.masterClient)
-	return grpcServer
+	healthpb.RegisterHealthServer(grpcServer, s.health)
+	if s.checkpointDirForInit != "" {
+		s.lock.Lock()
+		go s.restoreCheckpoint(grpcServer)
+	}
+	go s.startServe(grpcServer, lis, serverDone)
+	if s.masterClient != nil && s.heartbeatInterval > 0 {
+		go s.runHeartbeats(s.masterClient.context)
+	}
+	return grpcServer, nil
 }
 
-func startServe(server *grpc.Server, lis net.Listener, serverDone chan bool, masterClient *MasterClient) {
-	defer masterClient.closeConn()
-	err := server.Serve(lis)
-	if err != nil {
-		log.Fatalf("GRPC failed to serve: %v", err)
+// Addr returns the address the PS listens on once it runs, which resolves
+// the port if Run is given port 0
+func (s *Server) Addr() string {
+	if s.addr == nil {
+		return ""
+	}
+	return s.addr.String()
+}
+
+func (s *Server) startServe(server *grpc.Server, lis net.Listener, serverDone chan bool) {
+	defer s.masterClient.closeConn()
+	if err := server.Serve(lis); err != nil {
+		s.logger.Error("GRPC failed to serve", "error", err)
+		s.setErr(err)
 	}
 	serverDone <- true
 }
+
+// setErr records the first error which stops the server
+func (s *Server) setErr(err error) {
+	s.errLock.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.errLock.Unlock()
+}
+
+// Err returns the error which stopped the server, or nil
+func (s *Server) Err() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.err
+}
+
+// Shutdown stops the server gracefully. The health service reports NOT_SERVING,
+// new RPCs are refused and in-flight RPCs are drained. Then a final checkpoint is
+// saved if checkpointDir is set and the model has changed since the last one,
+// and the master connection and embedding tables are closed. It returns the
+// first error of saving the checkpoint and closing the tables. If ctx is done
+// first, the remaining RPCs are cut off and the error of ctx is returned. The
+// final checkpoint is then skipped unless it is being saved already, in which
+// case it is abandoned: it completes in the background if the process lives on.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.setReady(false)
+	s.health.Shutdown()
+	if s.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+			s.logger.Warn("Cut off in-flight RPCs", "error", ctx.Err())
+		}
+	}
+	// handlers cut off by Stop still hold the read lock until they return
+	closed := make(chan error, 1)
+	go func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		var err error
+		if ctx.Err() == nil {
+			err = s.saveFinalCheckpoint()
+		} else {
+			s.logger.Warn("Skipped the final checkpoint", "error", ctx.Err())
+		}
+		s.masterClient.closeConn()
+		if closeErr := s.Model.Close(); err == nil {
+			err = closeErr
+		}
+		if closeErr := s.Opt.Close(); err == nil {
+			err = closeErr
+		}
+		closed <- err
+	}()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// saveFinalCheckpoint saves the model if it is not saved in the last checkpoint
+func (s *Server) saveFinalCheckpoint() error {
+	if s.checkpointDir == "" || !s.Model.Initialized {
+		return nil
+	}
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+	version := int(s.Model.GetVersion())
+	checkpointVersionDir := path.Join(s.checkpointDir, fmt.Sprintf("version-%d", version))
+	if n := len(s.savedCheckpointDirs); n > 0 && s.savedCheckpointDirs[n-1] == checkpointVersionDir {
+		return nil
+	}
+	size, err := s.saveCheckpoint(version)
+	if err != nil {
+		return err
+	}
+	s.logger.Info("Saved the final checkpoint", "model_version", version, "checkpoint_dir", checkpointVersionDir,
+		"bytes", size)
+	return nil
+}
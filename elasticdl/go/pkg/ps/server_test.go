@@ -14,19 +14,42 @@
 package ps
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"elasticdl.org/elasticdl/pkg/common"
+	"elasticdl.org/elasticdl/pkg/logging"
 	"elasticdl.org/elasticdl/pkg/proto"
+	"elasticdl.org/elasticdl/pkg/tracing"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/stretchr/testify/assert"
 	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework/tensor_go_proto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
 )
 
 const (
@@ -36,7 +59,12 @@ const (
 type masterServer struct {
 	proto.UnimplementedMasterServer
 	address      string
+	lock         sync.Mutex
 	modelVersion int32
+	reports      int
+	delay        time.Duration // the time to handle a report
+	psStatus     map[int32]*proto.PsStatus
+	heartbeats   int
 	server       *grpc.Server
 }
 
@@ -61,17 +89,96 @@ func (s *masterServer) stop() {
 // ReportVersion grpc service
 func (s *masterServer) ReportVersion(ctx context.Context, in *proto.ReportVersionRequest) (*empty.Empty, error) {
 	var res empty.Empty
+	s.lock.Lock()
+	delay := s.delay
+	s.lock.Unlock()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(delay):
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reports++
 	if in.ModelVersion > s.modelVersion {
 		s.modelVersion = in.ModelVersion
 	}
 	return &res, nil
 }
 
+// RegisterPs grpc service
+func (s *masterServer) RegisterPs(ctx context.Context, in *proto.PsStatus) (*empty.Empty, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.psStatus[in.PsId] = in
+	return &empty.Empty{}, nil
+}
+
+// PsHeartbeat grpc service
+func (s *masterServer) PsHeartbeat(ctx context.Context, in *proto.PsStatus) (*proto.PsHeartbeatResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.psStatus[in.PsId]; !ok {
+		return &proto.PsHeartbeatResponse{Registered: false}, nil
+	}
+	s.psStatus[in.PsId] = in
+	s.heartbeats++
+	return &proto.PsHeartbeatResponse{Registered: true}, nil
+}
+
+// getPsStatus returns the last status of a PS and the number of heartbeats
+func (s *masterServer) getPsStatus(psID int32) (*proto.PsStatus, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.psStatus[psID], s.heartbeats
+}
+
+// getModelVersion returns the latest version reported and the number of reports
+func (s *masterServer) getModelVersion() (int32, int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.modelVersion, s.reports
+}
+
+func (s *masterServer) setDelay(delay time.Duration) {
+	s.lock.Lock()
+	s.delay = delay
+	s.lock.Unlock()
+}
+
+// waitModelVersion waits until the master has got the model version
+func waitModelVersion(t *testing.T, s *masterServer, version int32) {
+	for i := 0; i < 500; i++ {
+		if v, _ := s.getModelVersion(); v == version {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	v, _ := s.getModelVersion()
+	t.Fatalf("the master has got version %d instead of %d", v, version)
+}
+
 func newMasterServer(addr string) *masterServer {
-	server := masterServer{modelVersion: int32(0), address: addr}
+	server := masterServer{modelVersion: int32(0), address: addr, psStatus: make(map[int32]*proto.PsStatus)}
 	return &server
 }
 
+// newTestServer creates a PS with an SGD optimizer applying gradients in one goroutine
+func newTestServer(t assert.TestingT, opts ...ServerOption) *Server {
+	opts = append([]ServerOption{WithOptimizer("SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;"),
+		WithNumGradThreads(1)}, opts...)
+	s, err := NewServer(opts...)
+	assert.Nil(t, err)
+	return s
+}
+
+// runServer starts serving s at addr
+func runServer(t assert.TestingT, s *Server, addr string, concurrentStreams int, serverDone chan bool) *grpc.Server {
+	gs, err := s.Run(addr, concurrentStreams, serverDone)
+	assert.Nil(t, err)
+	return gs
+}
+
 func createClient() (proto.PserverClient, context.Context, *grpc.ClientConn, context.CancelFunc) {
 	conn, err := grpc.Dial(ADDR, grpc.WithInsecure(), grpc.WithBlock())
 	if err != nil {
@@ -82,23 +189,40 @@ func createClient() (proto.PserverClient, context.Context, *grpc.ClientConn, con
 	return c, ctx, conn, cancel
 }
 
+func TestServerConfig(t *testing.T) {
+	config := newServerConfig(nil)
+	assert.Equal(t, time.Minute, config.MasterDialTimeout)
+	assert.Equal(t, 1, config.NumPsPods)
+	assert.Equal(t, time.Duration(0), config.HeartbeatInterval)
+
+	// WithConfig replaces the whole configuration, later options still apply
+	config = newServerConfig([]ServerOption{WithConfig(ServerConfig{KeepCheckpointMax: 1}), WithID(1, 2)})
+	assert.Equal(t, time.Duration(0), config.MasterDialTimeout)
+	assert.Equal(t, 1, config.KeepCheckpointMax)
+	assert.Equal(t, 2, config.NumPsPods)
+	defaults := DefaultServerConfig()
+	defaults.KeepCheckpointMax = 1
+	config = newServerConfig([]ServerOption{WithConfig(defaults)})
+	assert.Equal(t, time.Minute, config.MasterDialTimeout)
+	assert.Equal(t, 1, config.KeepCheckpointMax)
+}
+
 func TestMasterClient(t *testing.T) {
 	// Create a Master server
 	masterAddr := "localhost:12368"
 	masterServer := newMasterServer(masterAddr)
 	masterServer.run()
 	// New a PS server
-	s := NewServer(0, "SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;",
-		masterAddr, 0, "", "", 0, 0, 1, false)
+	s := newTestServer(t, WithMaster(masterAddr, time.Second, 0))
 
 	version := int32(2)
-	s.masterClient.reportVersion(version)
-	assert.Equal(t, masterServer.modelVersion, version)
-	s.masterClient.reportVersion(int32(1))
-	assert.Equal(t, masterServer.modelVersion, version)
+	assert.Nil(t, s.masterClient.reportVersion(context.Background(), version))
+	waitModelVersion(t, masterServer, version)
+	assert.Nil(t, s.masterClient.reportVersion(context.Background(), int32(1)))
+	waitModelVersion(t, masterServer, version)
 	version = int32(22)
-	s.masterClient.reportVersion(version)
-	assert.Equal(t, masterServer.modelVersion, version)
+	assert.Nil(t, s.masterClient.reportVersion(context.Background(), version))
+	waitModelVersion(t, masterServer, version)
 
 	masterServer.stop()
 	s.masterClient.closeConn()
@@ -107,9 +231,8 @@ func TestMasterClient(t *testing.T) {
 func TestPushModel(t *testing.T) {
 	// Create a PS server
 	serverDone := make(chan bool)
-	s := NewServer(0, "SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;",
-		"", 0, "", "", 0, 0, 1, false)
-	gs := s.Run(ADDR, 1, serverDone)
+	s := newTestServer(t)
+	gs := runServer(t, s, ADDR, 1, serverDone)
 	client, ctx, conn, cancel := createClient()
 	defer conn.Close()
 	defer cancel()
@@ -157,9 +280,8 @@ func TestPushModel(t *testing.T) {
 func TestPullEmbeddingVectors(t *testing.T) {
 	// Create a PS server
 	serverDone := make(chan bool)
-	s := NewServer(0, "SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;",
-		"", 0, "", "", 0, 0, 1, false)
-	gs := s.Run(ADDR, 1, serverDone)
+	s := newTestServer(t)
+	gs := runServer(t, s, ADDR, 1, serverDone)
 	client, ctx, conn, cancel := createClient()
 	defer conn.Close()
 	defer cancel()
@@ -207,12 +329,77 @@ func TestPullEmbeddingVectors(t *testing.T) {
 	gs.Stop()
 }
 
+func TestPullEmbeddingVectorsReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	c := []float32{1, 2}
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:        "e1",
+			Dim:         2,
+			Initializer: "zero",
+			Dtype:       common.Float32,
+		}},
+		EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+			"e1": common.NewIndexedSlices(common.NewTensor(c, []int64{1, 2}), []int64{1}).SerializeToIndexedSlicesProto(),
+		},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+
+	// ids without rows are pulled as initialized rows, but their rows are not created
+	pullReq := &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{1, 2}, ReadOnly: true}
+	resp, err := s.PullEmbeddingVectors(context.Background(), pullReq)
+	assert.Nil(t, err)
+	assert.True(t, common.CompareFloatArray([]float32{1, 2, 0, 0},
+		common.Slice(common.DeserializeFromTensorProto(resp)).([]float32), 0.0001))
+	assert.Equal(t, 1, s.Model.GetEmbeddingTable("e1").Len())
+
+	pullReq.ReadOnly = false
+	_, err = s.PullEmbeddingVectors(context.Background(), pullReq)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.Model.GetEmbeddingTable("e1").Len())
+}
+
+func TestPullQuantizedEmbeddingVectors(t *testing.T) {
+	s := newTestServer(t)
+	c := make([]float32, 10)
+	for i := range c {
+		c[i] = rand.Float32()
+	}
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:         "e1",
+			Dim:          10,
+			Initializer:  "zero",
+			Dtype:        common.Float32,
+			StorageDtype: common.Int8,
+		}},
+		EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+			"e1": common.NewIndexedSlices(common.NewTensor(c, []int64{1, 10}), []int64{1}).SerializeToIndexedSlicesProto(),
+		},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+
+	pullReq := &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{1}}
+	resp, err := s.PullEmbeddingVectors(context.Background(), pullReq)
+	assert.Nil(t, err)
+	assert.InDeltaSlice(t, c, common.Slice(common.DeserializeFromTensorProto(resp)).([]float32), 0.005)
+
+	// compact pulls return the int8 rows with their scales and offsets
+	pullReq.Compact = true
+	resp, err = s.PullEmbeddingVectors(context.Background(), pullReq)
+	assert.Nil(t, err)
+	compact := common.DeserializeFromTensorProto(resp)
+	assert.Equal(t, common.Int8, compact.Dtype)
+	assert.Equal(t, []int64{1, 18}, compact.Dims)
+}
+
 func TestPullDenseParameters(t *testing.T) {
 	// Create a PS server
 	serverDone := make(chan bool)
-	s := NewServer(0, "SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;",
-		"", 0, "", "", 0, 0, 1, false)
-	gs := s.Run(ADDR, 1, serverDone)
+	s := newTestServer(t)
+	gs := runServer(t, s, ADDR, 1, serverDone)
 	client, ctx, conn, cancel := createClient()
 	defer conn.Close()
 	defer cancel()
@@ -265,9 +452,8 @@ func TestPullDenseParameters(t *testing.T) {
 func TestPushGradients(t *testing.T) {
 	// Create a PS server
 	serverDone := make(chan bool)
-	s := NewServer(0, "SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;",
-		"", 0, "", "", 0, 0, 1, false)
-	gs := s.Run(ADDR, 1, serverDone)
+	s := newTestServer(t)
+	gs := runServer(t, s, ADDR, 1, serverDone)
 	client, ctx, conn, cancel := createClient()
 	defer conn.Close()
 	defer cancel()
@@ -331,3 +517,881 @@ func TestPushGradients(t *testing.T) {
 	assert.True(t, common.CompareFloatArray(expectede1, common.Slice(s.Model.GetEmbeddingTable("e1").GetEmbeddingVector(1)).([]float32), 0.0001))
 	gs.Stop()
 }
+
+func TestConcurrentPushAndPull(t *testing.T) {
+	// Create a PS server
+	serverDone := make(chan bool)
+	s := newTestServer(t,
+		WithOptimizer("Adam", "learning_rate=0.1;beta_1=0.9;beta_2=0.999;epsilon=1e-8;amsgrad=false;"),
+		WithNumGradThreads(4))
+	gs := runServer(t, s, ADDR, 16, serverDone)
+	client, ctx, conn, cancel := createClient()
+	defer conn.Close()
+	defer cancel()
+
+	var modelReq = &proto.Model{
+		DenseParameters: make(map[string]*tensor_go_proto.TensorProto),
+		EmbeddingTables: make(map[string]*proto.IndexedSlicesProto),
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:        "e1",
+			Dim:         10,
+			Initializer: "zero",
+			Dtype:       common.Float32,
+		}},
+	}
+	a := make([]float32, 10)
+	c := make([]float32, 10)
+	for i := 0; i < 10; i++ {
+		a[i] = rand.Float32()
+		c[i] = rand.Float32()
+	}
+	modelReq.DenseParameters["t1"] = common.NewTensor(a, []int64{2, 5}).SerializeToTensorProto()
+	modelReq.EmbeddingTables["e1"] = common.NewIndexedSlices(common.NewTensor(c, []int64{1, 10}), []int64{1}).SerializeToIndexedSlicesProto()
+	_, err := client.PushModel(ctx, modelReq)
+	assert.Nil(t, err)
+
+	const workers int = 8
+	const steps int = 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < steps; i++ {
+				resp, err := client.PushGradients(ctx, &proto.PushGradientsRequest{Gradients: modelReq})
+				assert.Nil(t, err)
+				assert.True(t, resp.Accepted)
+				dense, err := client.PullDenseParameters(ctx, &proto.PullDenseParametersRequest{Version: 0})
+				assert.Nil(t, err)
+				assert.Contains(t, dense.DenseParameters, "t1")
+				_, err = client.PullEmbeddingVectors(ctx, &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{1, 2}})
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp, err := client.PullDenseParameters(ctx, &proto.PullDenseParametersRequest{Version: 0})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(workers*steps), resp.Version)
+	gs.Stop()
+}
+
+func TestEvictEmbeddingRows(t *testing.T) {
+	s := newTestServer(t,
+		WithOptimizer("Adam", "learning_rate=0.1;beta_1=0.9;beta_2=0.999;epsilon=1e-7;amsgrad=false;"))
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:        "e1",
+			Dim:         2,
+			Initializer: "zero",
+			Dtype:       common.Float32,
+			Ttl:         1,
+		}},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+
+	push := func(ids ...int64) {
+		grad := common.NewTensor(make([]float32, 2*len(ids)), []int64{int64(len(ids)), 2})
+		gradReq := &proto.PushGradientsRequest{
+			Gradients: &proto.Model{
+				Version: s.Model.GetVersion(),
+				EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+					"e1": common.NewIndexedSlices(grad, ids).SerializeToIndexedSlicesProto(),
+				},
+			},
+		}
+		resp, err := s.PushGradients(context.Background(), gradReq)
+		assert.Nil(t, err)
+		assert.True(t, resp.Accepted)
+	}
+	push(1, 2)
+	push(1)
+	push(1)
+	opt := s.Opt.(*AdamOptimizer)
+	assert.Equal(t, 1, s.Model.GetEmbeddingTable("e1").Len())
+	assert.True(t, s.Model.GetEmbeddingTable("e1").Contains(1))
+	assert.Equal(t, 1, opt.m.GetEmbeddingTable("e1").Len())
+	assert.Equal(t, 1, opt.v.GetEmbeddingTable("e1").Len())
+	assert.Equal(t, int64(1), s.Model.GetEmbeddingTable("e1").GetEvictionStats().Expired)
+
+	// eviction policy is kept in checkpoints
+	info := s.Model.SaveToModelPB().EmbeddingTableInfos[0]
+	assert.Equal(t, int32(1), info.Ttl)
+}
+
+func TestEmbeddingSlotsOnDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEmbeddingSlotsOnDisk")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s := newTestServer(t, WithEmbeddingDiskDir(dir),
+		WithOptimizer("Adam", "learning_rate=0.1;beta_1=0.9;beta_2=0.999;epsilon=1e-7;amsgrad=false;"))
+	defer s.Shutdown(context.Background())
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:         "e1",
+			Dim:          2,
+			Initializer:  "zero",
+			Dtype:        common.Float32,
+			StorageDtype: common.Half,
+			CacheRows:    10,
+		}},
+	}
+	_, err = s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+	opt := s.Opt.(*AdamOptimizer)
+	for _, slots := range []*Model{opt.m, opt.v} {
+		assert.Equal(t, common.Float32, slots.GetEmbeddingTable("e1").StorageDtype)
+		assert.Equal(t, int64(10), slots.GetEmbeddingTable("e1").CacheRows)
+	}
+
+	ids := make([]int64, 20)
+	for i := range ids {
+		ids[i] = int64(i)
+	}
+	grad := common.NewTensor(make([]float32, 2*len(ids)), []int64{int64(len(ids)), 2})
+	gradReq := &proto.PushGradientsRequest{
+		Gradients: &proto.Model{
+			EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+				"e1": common.NewIndexedSlices(grad, ids).SerializeToIndexedSlicesProto(),
+			},
+		},
+	}
+	_, err = s.PushGradients(context.Background(), gradReq)
+	assert.Nil(t, err)
+
+	// the slots of rows moved to disk are moved with them
+	diskRows := s.Model.GetEmbeddingTable("e1").GetStats().DiskRows
+	assert.True(t, diskRows > 0)
+	for _, slots := range []*Model{opt.m, opt.v} {
+		stats := slots.GetEmbeddingTable("e1").GetStats()
+		assert.Equal(t, int64(20), stats.Rows)
+		assert.Equal(t, diskRows, stats.DiskRows)
+	}
+	_, err = os.Stat(filepath.Join(dir, ".optimizer", "0", "e1"))
+	assert.Nil(t, err)
+}
+
+func TestEmbeddingAdmission(t *testing.T) {
+	s := newTestServer(t)
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:               "e1",
+			Dim:                2,
+			Initializer:        "ones",
+			Dtype:              common.Float32,
+			AdmissionThreshold: 2,
+		}},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+
+	pull := func() []float32 {
+		pullReq := &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{1}}
+		resp, err := s.PullEmbeddingVectors(context.Background(), pullReq)
+		assert.Nil(t, err)
+		return common.Slice(common.DeserializeFromTensorProto(resp)).([]float32)
+	}
+	push := func() {
+		grad := common.NewTensor([]float32{1, 1}, []int64{1, 2})
+		gradReq := &proto.PushGradientsRequest{
+			Gradients: &proto.Model{
+				EmbeddingTables: map[string]*proto.IndexedSlicesProto{
+					"e1": common.NewIndexedSlices(grad, []int64{1}).SerializeToIndexedSlicesProto(),
+				},
+			},
+		}
+		_, err := s.PushGradients(context.Background(), gradReq)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []float32{0, 0}, pull())
+	push()
+	assert.Equal(t, 0, s.Model.GetEmbeddingTable("e1").Len())
+	assert.Equal(t, []float32{1, 1}, pull())
+	push()
+	assert.True(t, common.CompareFloatArray([]float32{0.9, 0.9}, pull(), 0.0001))
+}
+
+// BenchmarkPullEmbeddingVectors measures the throughput of concurrent pulls,
+// in which about half of the ids create new rows
+func BenchmarkPullEmbeddingVectors(b *testing.B) {
+	for _, callers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("callers=%d", callers), func(b *testing.B) {
+			s := newTestServer(b)
+			var modelReq = &proto.Model{
+				EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+					Name:        "e1",
+					Dim:         16,
+					Initializer: "uniform",
+					Dtype:       common.Float32,
+				}},
+			}
+			s.PushModel(context.Background(), modelReq)
+			var done int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for c := 0; c < callers; c++ {
+				wg.Add(1)
+				go func(seed int64) {
+					defer wg.Done()
+					rng := rand.New(rand.NewSource(seed))
+					ids := make([]int64, 256)
+					for atomic.AddInt64(&done, 1) <= int64(b.N) {
+						for i := range ids {
+							ids[i] = rng.Int63n(1 << 20)
+						}
+						req := &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: ids}
+						if _, err := s.PullEmbeddingVectors(context.Background(), req); err != nil {
+							b.Error(err)
+						}
+					}
+				}(int64(c))
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestPullEmbeddingVectorsByKeys(t *testing.T) {
+	s := newTestServer(t)
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+			Name:        "e1",
+			Dim:         2,
+			Initializer: "ones",
+			Dtype:       common.Float32,
+			KeyType:     proto.EmbeddingKeyType_STRING_KEY,
+		}},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+
+	_, err = s.PullEmbeddingVectors(context.Background(), &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{1}})
+	assert.NotNil(t, err)
+
+	grad := &common.IndexedSlices{ConcatTensors: common.NewTensor([]float32{1, 1}, []int64{1, 2}), Keys: []string{"a"}}
+	gradReq := &proto.PushGradientsRequest{
+		Gradients: &proto.Model{
+			EmbeddingTables: map[string]*proto.IndexedSlicesProto{"e1": grad.SerializeToIndexedSlicesProto()},
+		},
+	}
+	_, err = s.PushGradients(context.Background(), gradReq)
+	assert.Nil(t, err)
+
+	pullReq := &proto.PullEmbeddingVectorsRequest{Name: "e1", Keys: []string{"a", "b"}, ReadOnly: true}
+	resp, err := s.PullEmbeddingVectors(context.Background(), pullReq)
+	assert.Nil(t, err)
+	assert.True(t, common.CompareFloatArray([]float32{0.9, 0.9, 1, 1},
+		common.Slice(common.DeserializeFromTensorProto(resp)).([]float32), 0.0001))
+	assert.Equal(t, 1, s.Model.GetEmbeddingTable("e1").Len())
+
+	pullReq.ReadOnly = false
+	_, err = s.PullEmbeddingVectors(context.Background(), pullReq)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, s.Model.GetEmbeddingTable("e1").Len())
+}
+
+func TestGetEmbeddingTableStats(t *testing.T) {
+	s := newTestServer(t)
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{
+			&proto.EmbeddingTableInfo{Name: "e2", Dim: 2, Initializer: "ones", Dtype: common.Float32},
+			&proto.EmbeddingTableInfo{Name: "e1", Dim: 4, Initializer: "zero", Dtype: common.Float32},
+		},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+	_, err = s.PullEmbeddingVectors(context.Background(), &proto.PullEmbeddingVectorsRequest{Name: "e2", Ids: []int64{1, 2}})
+	assert.Nil(t, err)
+
+	resp, err := s.GetEmbeddingTableStats(context.Background(), &proto.GetEmbeddingTableStatsRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, resp.Tables, 2)
+	assert.Equal(t, "e1", resp.Tables[0].Name)
+	assert.Equal(t, int64(4), resp.Tables[0].Dim)
+	assert.Equal(t, int64(0), resp.Tables[0].Rows)
+	assert.Equal(t, "e2", resp.Tables[1].Name)
+	assert.Equal(t, "ones", resp.Tables[1].Initializer)
+	assert.Equal(t, int64(2), resp.Tables[1].Rows)
+	assert.Equal(t, int64(1), resp.Tables[1].Pulls)
+	assert.Equal(t, []int64{2}, resp.Tables[1].AccessHistogram)
+
+	_, err = s.GetEmbeddingTableStats(context.Background(), &proto.GetEmbeddingTableStatsRequest{Names: []string{"e3"}})
+	assert.NotNil(t, err)
+}
+
+func TestServerMetrics(t *testing.T) {
+	s := newTestServer(t)
+	var modelReq = &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{
+			&proto.EmbeddingTableInfo{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32},
+		},
+	}
+	_, err := s.PushModel(context.Background(), modelReq)
+	assert.Nil(t, err)
+	grad := common.NewIndexedSlices(common.NewTensor([]float32{1, 1}, []int64{1, 2}), []int64{3})
+	gradReq := &proto.PushGradientsRequest{
+		Gradients: &proto.Model{
+			EmbeddingTables: map[string]*proto.IndexedSlicesProto{"e1": grad.SerializeToIndexedSlicesProto()},
+		},
+	}
+	_, err = s.PushGradients(context.Background(), gradReq)
+	assert.Nil(t, err)
+	gradReq.Gradients.EmbeddingTables["e2"] = gradReq.Gradients.EmbeddingTables["e1"]
+	_, err = s.PushGradients(context.Background(), gradReq)
+	assert.NotNil(t, err)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/proto.Pserver/pull_embedding_vectors"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	s.metrics.unaryInterceptor(context.Background(), nil, info, handler)
+
+	httpServer, err := s.RunHTTP("localhost:12370")
+	assert.Nil(t, err)
+	defer httpServer.Close()
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://localhost:12370/metrics"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	text := string(body)
+	assert.Contains(t, text, "elasticdl_ps_gradient_pushes_total 1\n")
+	assert.Contains(t, text, "elasticdl_ps_rejected_gradient_pushes_total 1\n")
+	assert.Contains(t, text, "elasticdl_ps_model_version 1\n")
+	assert.Contains(t, text, "elasticdl_ps_optimizer_step 2\n")
+	assert.Contains(t, text, "elasticdl_ps_gradient_staleness_count 1\n")
+	assert.Contains(t, text, "elasticdl_ps_embedding_rows{table=\"e1\"} 1\n")
+	assert.Contains(t, text, "elasticdl_ps_rpc_requests_total{code=\"OK\",method=\"/proto.Pserver/pull_embedding_vectors\"} 1\n")
+
+	// scrapes do not wait for the server lock, which is held while the model is restored
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	scraped := make(chan string)
+	go func() { scraped <- writeMetrics(s) }()
+	select {
+	case text = <-scraped:
+		assert.Contains(t, text, "elasticdl_ps_embedding_rows{table=\"e1\"} 1\n")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the scrape waits for the server lock")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestHealth")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	model := NewModel()
+	assert.Nil(t, model.SetEmbeddingTableInfo(&proto.EmbeddingTableInfo{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}))
+	model.EmbeddingTables["e1"].SetEmbeddingVectors(
+		common.NewIndexedSlices(common.NewTensor([]float32{1, 2}, []int64{1, 2}), []int64{3}))
+	_, err = SaveModelToCheckpoint(dir, model, 0, 1)
+	assert.Nil(t, err)
+
+	addr := "localhost:12371"
+	for _, checkpointDir := range []string{"", dir} {
+		s := newTestServer(t, WithCheckpointDirForInit(checkpointDir))
+		rec := httptest.NewRecorder()
+		s.handleReadiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		rec = httptest.NewRecorder()
+		s.handleLiveness(rec, httptest.NewRequest("GET", "/healthz", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		serverDone := make(chan bool)
+		gs := runServer(t, s, addr, 1, serverDone)
+		conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock())
+		assert.Nil(t, err)
+		client := healthpb.NewHealthClient(conn)
+		if checkpointDir == "" {
+			resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: pserverService})
+			assert.Nil(t, err)
+			assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+			_, err = s.PushModel(context.Background(), &proto.Model{})
+			assert.Nil(t, err)
+		}
+		for i := 0; i < 100 && !s.isReady(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		assert.Nil(t, err)
+		assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+		rec = httptest.NewRecorder()
+		s.handleReadiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if checkpointDir != "" {
+			v, err := s.PullEmbeddingVectors(context.Background(), &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{3}})
+			assert.Nil(t, err)
+			assert.Equal(t, []float32{1, 2}, common.Slice(common.DeserializeFromTensorProto(v)).([]float32))
+		}
+		conn.Close()
+		gs.Stop()
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+	dir, err := ioutil.TempDir("", "TestTracing")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	masterAddr := "localhost:12373"
+	master := newMasterServer(masterAddr)
+	master.run()
+	defer master.stop()
+	addr := "localhost:12372"
+	// registration and heartbeats would start traces of their own
+	s := newTestServer(t, WithMaster(masterAddr, time.Second, 1), WithCheckpoint(dir, 1, 0), WithHeartbeat("", 0))
+	gs := runServer(t, s, addr, 1, make(chan bool, 1))
+	defer gs.Stop()
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(tracing.UnaryClientInterceptor))
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := proto.NewPserverClient(conn)
+
+	model := &proto.Model{
+		DenseParameters: map[string]*tensor_go_proto.TensorProto{
+			"t1": common.NewTensor([]float32{1, 2}, []int64{1, 2}).SerializeToTensorProto(),
+		},
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}},
+	}
+	_, err = client.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+	model.EmbeddingTables = map[string]*proto.IndexedSlicesProto{
+		"e1": common.NewIndexedSlices(common.NewTensor([]float32{1, 2}, []int64{1, 2}), []int64{3}).SerializeToIndexedSlicesProto(),
+	}
+	exporter.Reset()
+	_, err = client.PushGradients(context.Background(), &proto.PushGradientsRequest{Gradients: model})
+	assert.Nil(t, err)
+
+	// the version is reported in the background, the spans end after the master handles it
+	waitModelVersion(t, master, 1)
+	reported := func() bool {
+		for _, span := range exporter.GetSpans() {
+			if span.Name == "reportVersion" {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; i < 100 && !reported(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spans := exporter.GetSpans()
+	names := make(map[string]bool)
+	for _, span := range spans {
+		names[span.Name] = true
+		assert.Equal(t, spans[0].SpanContext.TraceID(), span.SpanContext.TraceID())
+	}
+	for _, name := range []string{"/proto.Pserver/push_gradients", "lockParameters",
+		"DeserializeFromTensorProto", "DeserializeFromIndexedSliceProto", "DenseKernel", "SparseKernel",
+		"saveCheckpointIfNeeded", "reportModelVersionIfNeeded", "reportVersion", "/proto.Master/report_version"} {
+		assert.True(t, names[name], name)
+	}
+}
+
+func TestLogInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestServer(t, WithLogger(logging.NewLogger(&buf, slog.LevelDebug)))
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}})
+	info := &grpc.UnaryServerInfo{FullMethod: "/proto.Pserver/pull_embedding_vectors"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		logging.FromContext(ctx).Info("handling")
+		return s.PullEmbeddingVectors(ctx, req.(*proto.PullEmbeddingVectorsRequest))
+	}
+	_, err := s.logInterceptor(ctx, &proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{1}}, info, handler)
+	assert.NotNil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	var records []map[string]interface{}
+	for _, line := range lines {
+		var record map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &record))
+		assert.Equal(t, float64(0), record["ps_id"])
+		assert.Equal(t, info.FullMethod, record["method"])
+		assert.Equal(t, "10.0.0.1:1234", record["peer"])
+		records = append(records, record)
+	}
+	assert.Equal(t, "handling", records[0]["msg"])
+	assert.Equal(t, "ERROR", records[1]["level"])
+	assert.Equal(t, "RPC failed", records[1]["msg"])
+	assert.Equal(t, "Unknown", records[1]["code"])
+	assert.Equal(t, float64(0), records[1]["model_version"])
+	assert.Contains(t, records[1]["error"], "e1")
+}
+
+func TestServerErrors(t *testing.T) {
+	_, err := NewServer(WithOptimizer("SGD", "learning_rate=0.1"))
+	assert.NotNil(t, err)
+	_, err = NewServer(WithOptimizer("SGD", "learning_rate=0.1;momentum=0.0;nesterov=false;"),
+		WithMaster("localhost:12375", 100*time.Millisecond, 0))
+	assert.NotNil(t, err)
+
+	addr := "localhost:12374"
+	lis, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	s := newTestServer(t)
+	_, err = s.Run(addr, 1, make(chan bool, 1))
+	assert.NotNil(t, err)
+	_, err = s.RunHTTP(addr)
+	assert.NotNil(t, err)
+	lis.Close()
+
+	// a server fails to restore the model from a missing checkpoint and stops
+	s = newTestServer(t, WithCheckpointDirForInit(path.Join(os.TempDir(), "TestServerErrors-missing")))
+	serverDone := make(chan bool, 1)
+	_, err = s.Run(addr, 1, serverDone)
+	assert.Nil(t, err)
+	select {
+	case <-serverDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	assert.NotNil(t, s.Err())
+	assert.False(t, s.Model.Initialized)
+	assert.False(t, s.isReady())
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestShutdown")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	addr := "localhost:12376"
+	s := newTestServer(t, WithCheckpoint(dir, 0, 3))
+	runServer(t, s, addr, 1, make(chan bool, 1))
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithBlock())
+	assert.Nil(t, err)
+	defer conn.Close()
+	client := proto.NewPserverClient(conn)
+	model := &proto.Model{
+		DenseParameters: map[string]*tensor_go_proto.TensorProto{
+			"t1": common.NewTensor([]float32{1, 2}, []int64{1, 2}).SerializeToTensorProto(),
+		},
+	}
+	_, err = client.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+	_, err = client.PushGradients(context.Background(), &proto.PushGradientsRequest{Gradients: model})
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Shutdown(context.Background()))
+	assert.False(t, s.isReady())
+	_, err = client.PullDenseParameters(context.Background(), &proto.PullDenseParametersRequest{})
+	assert.NotNil(t, err)
+	restored := NewModel()
+	assert.Nil(t, loadCheckpoint(restored, path.Join(dir, "version-1"), 0, 1))
+	assert.Equal(t, []float32{0.9, 1.8}, common.Slice(restored.GetDenseParameter("t1")).([]float32))
+
+	// a checkpoint which fails to save fails the shutdown
+	file := path.Join(dir, "file")
+	assert.Nil(t, ioutil.WriteFile(file, nil, 0644))
+	s = newTestServer(t, WithCheckpoint(file, 0, 3))
+	_, err = s.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+	assert.NotNil(t, s.Shutdown(context.Background()))
+
+	// a handler which does not return holds the shutdown until the deadline, and
+	// the final checkpoint is skipped once it returns
+	s = newTestServer(t, WithCheckpoint(path.Join(dir, "skipped"), 0, 3))
+	_, err = s.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+	s.lock.RLock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+	s.lock.RUnlock()
+	for !s.lock.TryLock() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.lock.Unlock()
+	_, err = os.Stat(path.Join(dir, "skipped"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWatchMaster(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assertLost := func(lost <-chan struct{}, expected bool, timeout time.Duration) {
+		select {
+		case <-lost:
+			assert.True(t, expected, "the master is lost")
+		case <-time.After(timeout):
+			assert.False(t, expected, "the master is not lost")
+		}
+	}
+
+	// a master with the health service is lost once it is not SERVING
+	addr := "localhost:12377"
+	lis, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	gs := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(gs, healthServer)
+	go gs.Serve(lis)
+	defer gs.Stop()
+	s := newTestServer(t, WithMaster(addr, time.Second, 0))
+	lost := s.WatchMaster(ctx, 200*time.Millisecond)
+	assertLost(lost, false, 500*time.Millisecond)
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	assertLost(lost, true, 5*time.Second)
+
+	// a master without the health service is lost once it stops
+	addr = "localhost:12378"
+	master := newMasterServer(addr)
+	master.run()
+	s = newTestServer(t, WithMaster(addr, time.Second, 0))
+	lost = s.WatchMaster(ctx, 200*time.Millisecond)
+	assertLost(lost, false, 500*time.Millisecond)
+	master.stop()
+	assertLost(lost, true, 5*time.Second)
+
+	// without a master, the channel is never closed
+	assertLost(newTestServer(t).WatchMaster(ctx, 0), false, 100*time.Millisecond)
+}
+
+// TestStandaloneShards runs PS shards in-process at any free port without a
+// reachable master, as for local development and integration tests
+func TestStandaloneShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestStandaloneShards")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	const numPsPods = 3
+	names := []string{"t0", "t1", "t2", "t3", "t4", "t5"}
+	ids := []int64{0, 1, 2, 3, 4, 5}
+	value := func(i int) []float32 { return []float32{float32(i), float32(i) + 0.5} }
+
+	servers := make([]*Server, numPsPods)
+	clients := make([]proto.PserverClient, numPsPods)
+	for i := range servers {
+		// NewServer neither blocks nor fails without the master, and reports fail in the background
+		servers[i] = newTestServer(t, WithID(i, numPsPods), WithMaster("localhost:12379", 0, 1),
+			WithCheckpoint(dir, 0, 3))
+		runServer(t, servers[i], "localhost:0", 1, make(chan bool, 1))
+		assert.NotEqual(t, "localhost:0", servers[i].Addr())
+		conn, err := grpc.Dial(servers[i].Addr(), grpc.WithInsecure(), grpc.WithBlock())
+		assert.Nil(t, err)
+		defer conn.Close()
+		clients[i] = proto.NewPserverClient(conn)
+	}
+
+	// shard the model as workers do
+	models := make([]*proto.Model, numPsPods)
+	for i := range models {
+		models[i] = &proto.Model{
+			DenseParameters: make(map[string]*tensor_go_proto.TensorProto),
+			EmbeddingTables: make(map[string]*proto.IndexedSlicesProto),
+			EmbeddingTableInfos: []*proto.EmbeddingTableInfo{&proto.EmbeddingTableInfo{
+				Name:        "e1",
+				Dim:         2,
+				Initializer: "zero",
+				Dtype:       common.Float32,
+			}},
+		}
+	}
+	for i, name := range names {
+		models[StringToID(name, numPsPods)].DenseParameters[name] =
+			common.NewTensor(value(i), []int64{1, 2}).SerializeToTensorProto()
+	}
+	shardIDs := make([][]int64, numPsPods)
+	for _, id := range ids {
+		shardIDs[IntToID(id, numPsPods)] = append(shardIDs[IntToID(id, numPsPods)], id)
+	}
+	for i, model := range models {
+		var rows []float32
+		for _, id := range shardIDs[i] {
+			rows = append(rows, value(int(id))...)
+		}
+		tensor := common.NewTensor(rows, []int64{int64(len(shardIDs[i])), 2})
+		model.EmbeddingTables["e1"] = common.NewIndexedSlices(tensor, shardIDs[i]).SerializeToIndexedSlicesProto()
+		_, err = clients[i].PushModel(context.Background(), model)
+		assert.Nil(t, err)
+		_, err = clients[i].PushGradients(context.Background(), &proto.PushGradientsRequest{Gradients: model})
+		assert.Nil(t, err)
+	}
+
+	expected := func(i int) []float32 { return []float32{0.9 * float32(i), 0.9 * (float32(i) + 0.5)} }
+	for i, name := range names {
+		resp, err := clients[StringToID(name, numPsPods)].PullDenseParameters(context.Background(),
+			&proto.PullDenseParametersRequest{Version: -1})
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), resp.Version)
+		assert.InDeltaSlice(t, expected(i),
+			common.Slice(common.DeserializeFromTensorProto(resp.DenseParameters[name])).([]float32), 0.0001)
+	}
+	for _, id := range ids {
+		resp, err := clients[IntToID(id, numPsPods)].PullEmbeddingVectors(context.Background(),
+			&proto.PullEmbeddingVectorsRequest{Name: "e1", Ids: []int64{id}})
+		assert.Nil(t, err)
+		assert.InDeltaSlice(t, expected(int(id)), common.Slice(common.DeserializeFromTensorProto(resp)).([]float32), 0.0001)
+	}
+
+	// the shards save their final checkpoints to the same directory, which reshards on loading
+	for _, s := range servers {
+		assert.Nil(t, s.Shutdown(context.Background()))
+	}
+	for shardID := 0; shardID < 2; shardID++ {
+		model, err := LoadModelFromCheckpoint(path.Join(dir, "version-1"), shardID, 2)
+		assert.Nil(t, err)
+		for i, name := range names {
+			if StringToID(name, 2) == shardID {
+				assert.InDeltaSlice(t, expected(i), common.Slice(model.GetDenseParameter(name)).([]float32), 0.0001)
+			} else {
+				assert.Nil(t, model.GetDenseParameter(name))
+			}
+		}
+		for _, id := range ids {
+			if IntToID(id, 2) == shardID {
+				assert.InDeltaSlice(t, expected(int(id)),
+					common.Slice(model.GetEmbeddingTable("e1").GetEmbeddingVector(id)).([]float32), 0.0001)
+			}
+		}
+	}
+}
+
+// writeMetrics returns the metrics of s in the Prometheus text format
+func writeMetrics(s *Server) string {
+	w := httptest.NewRecorder()
+	s.metrics.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	return w.Body.String()
+}
+
+func TestMasterReports(t *testing.T) {
+	// reports to a slow master do not block and only the latest queued version is sent
+	masterAddr := "localhost:12381"
+	master := newMasterServer(masterAddr)
+	master.run()
+	master.setDelay(50 * time.Millisecond)
+	s := newTestServer(t, WithMaster(masterAddr, time.Second, 1))
+	start := time.Now()
+	for v := int32(1); v <= 20; v++ {
+		s.masterClient.reportVersionAsync(context.Background(), v)
+	}
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+	waitModelVersion(t, master, 20)
+	// the client observes the report after the master handles it
+	for i := 0; i < 100 && !strings.Contains(writeMetrics(s), "elasticdl_ps_master_reported_version 20\n"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, reports := master.getModelVersion()
+	assert.True(t, reports < 20, reports)
+	text := writeMetrics(s)
+	assert.Contains(t, text, "elasticdl_ps_master_reported_version 20\n")
+	assert.Contains(t, text, fmt.Sprintf("elasticdl_ps_master_reports_total{code=\"OK\"} %d\n", reports))
+	assert.NotContains(t, text, "elasticdl_ps_master_coalesced_reports_total 0\n")
+
+	// a report which takes longer than the timeout fails
+	master.setDelay(time.Second)
+	s.masterClient.reportTimeout = 100 * time.Millisecond
+	assert.NotNil(t, s.masterClient.reportVersion(context.Background(), 21))
+	assert.Contains(t, writeMetrics(s), "elasticdl_ps_master_reports_total{code=\"DeadlineExceeded\"} 1\n")
+	s.masterClient.closeConn()
+	master.stop()
+
+	// reports to a master which is not reachable yet are retried after it starts
+	s = newTestServer(t, WithMaster(masterAddr, 0, 1), WithMasterReportTimeout(100*time.Millisecond))
+	defer s.masterClient.closeConn()
+	s.masterClient.reportVersionAsync(context.Background(), 5)
+	time.Sleep(300 * time.Millisecond)
+	assert.NotContains(t, writeMetrics(s), "elasticdl_ps_master_reports_total{code=\"OK\"}")
+	master = newMasterServer(masterAddr)
+	master.run()
+	defer master.stop()
+	waitModelVersion(t, master, 5)
+	assert.Contains(t, writeMetrics(s), "elasticdl_ps_master_reports_total{code=\"DeadlineExceeded\"}")
+}
+
+func TestInflightRPCs(t *testing.T) {
+	var inflight inflightRPCs
+	assert.Equal(t, time.Duration(0), inflight.oldestAge())
+	first := inflight.start()
+	time.Sleep(20 * time.Millisecond)
+	second := inflight.start()
+	assert.True(t, inflight.oldestAge() >= 20*time.Millisecond)
+	inflight.end(first)
+	assert.True(t, inflight.oldestAge() < 20*time.Millisecond)
+	inflight.end(second)
+	assert.Equal(t, time.Duration(0), inflight.oldestAge())
+}
+
+func TestHeartbeat(t *testing.T) {
+	masterAddr := "localhost:12382"
+	master := newMasterServer(masterAddr)
+	master.run()
+	defer master.stop()
+	s := newTestServer(t, WithID(1, 2), WithMaster(masterAddr, time.Second, 0),
+		WithHeartbeat("", 20*time.Millisecond))
+	runServer(t, s, "localhost:0", 1, make(chan bool, 1))
+	waitStatus := func(check func(psStatus *proto.PsStatus, heartbeats int) bool) {
+		for i := 0; i < 500; i++ {
+			if psStatus, heartbeats := master.getPsStatus(1); psStatus != nil && check(psStatus, heartbeats) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("the master did not get the expected status")
+	}
+
+	// the PS registers and reports its status in heartbeats
+	waitStatus(func(psStatus *proto.PsStatus, heartbeats int) bool { return true })
+	psStatus, _ := master.getPsStatus(1)
+	assert.Equal(t, s.Addr(), psStatus.Addr)
+	assert.Equal(t, int32(2), psStatus.NumPsPods)
+	assert.Equal(t, int32(1), psStatus.HeartbeatIntervalSecs)
+	assert.False(t, psStatus.Ready)
+	model := &proto.Model{
+		EmbeddingTableInfos: []*proto.EmbeddingTableInfo{{Name: "e1", Dim: 2, Initializer: "zero", Dtype: common.Float32}},
+	}
+	_, err := s.PushModel(context.Background(), model)
+	assert.Nil(t, err)
+	model.EmbeddingTables = map[string]*proto.IndexedSlicesProto{
+		"e1": common.NewIndexedSlices(common.NewTensor([]float32{1, 2}, []int64{1, 2}), []int64{3}).SerializeToIndexedSlicesProto(),
+	}
+	_, err = s.PushGradients(context.Background(), &proto.PushGradientsRequest{Gradients: model})
+	assert.Nil(t, err)
+	waitStatus(func(psStatus *proto.PsStatus, heartbeats int) bool {
+		return psStatus.Ready && psStatus.ModelVersion == 1 && psStatus.EmbeddingTableRows["e1"] == 1
+	})
+
+	// a PS hung with the server lock held stops sending heartbeats
+	s.lock.Lock()
+	time.Sleep(50 * time.Millisecond)
+	_, heartbeats := master.getPsStatus(1)
+	time.Sleep(100 * time.Millisecond)
+	_, hungHeartbeats := master.getPsStatus(1)
+	assert.Equal(t, heartbeats, hungHeartbeats)
+	s.lock.Unlock()
+	waitStatus(func(psStatus *proto.PsStatus, heartbeats int) bool { return heartbeats > hungHeartbeats })
+
+	// so does a PS hung with a parameter lock held for write
+	s.Model.paramLock("e1").Lock()
+	time.Sleep(50 * time.Millisecond)
+	_, heartbeats = master.getPsStatus(1)
+	time.Sleep(100 * time.Millisecond)
+	_, hungHeartbeats = master.getPsStatus(1)
+	assert.Equal(t, heartbeats, hungHeartbeats)
+	s.Model.paramLock("e1").Unlock()
+	waitStatus(func(psStatus *proto.PsStatus, heartbeats int) bool { return heartbeats > hungHeartbeats })
+	psStatus, _ = master.getPsStatus(1)
+	assert.Equal(t, int64(0), psStatus.OldestRpcAgeSecs)
+
+	// the PS registers again once the master forgets it
+	master.lock.Lock()
+	delete(master.psStatus, 1)
+	master.lock.Unlock()
+	waitStatus(func(psStatus *proto.PsStatus, heartbeats int) bool { return true })
+
+	text := writeMetrics(s)
+	assert.Contains(t, text, "elasticdl_ps_master_heartbeats_total{code=\"OK\",method=\"register_ps\"} 2\n")
+	assert.Contains(t, text, "elasticdl_ps_master_heartbeats_total{code=\"OK\",method=\"ps_heartbeat\"}")
+	assert.Nil(t, s.Shutdown(context.Background()))
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The ElasticDL Authors. All rights reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestNewExporter(t *testing.T) {
+	exporter, err := NewExporter("stdout", "")
+	assert.Nil(t, err)
+	assert.Nil(t, exporter.Shutdown(context.Background()))
+	_, err = NewExporter("zipkin", "")
+	assert.NotNil(t, err)
+}
+
+func TestInterceptors(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	lis, err := net.Listen("tcp", "localhost:12380")
+	assert.Nil(t, err)
+	gs := grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor))
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	go gs.Serve(lis)
+	defer gs.Stop()
+	conn, err := grpc.Dial("localhost:12380", grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor))
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	ctx, span := Start(context.Background(), "step")
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	assert.Nil(t, err)
+	End(span, errors.New("failed"))
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, 3, len(spans))
+	var step, client, server tracetest.SpanStub
+	for _, s := range spans {
+		switch {
+		case s.Name == "step":
+			step = s
+		case s.SpanKind == trace.SpanKindClient:
+			client = s
+		case s.SpanKind == trace.SpanKindServer:
+			server = s
+		}
+	}
+	assert.Equal(t, "/grpc.health.v1.Health/Check", server.Name)
+	assert.Equal(t, step.SpanContext.TraceID(), server.SpanContext.TraceID())
+	assert.Equal(t, step.SpanContext.SpanID(), client.Parent.SpanID())
+	assert.Equal(t, client.SpanContext.SpanID(), server.Parent.SpanID())
+	assert.True(t, server.Parent.IsRemote())
+	assert.Equal(t, codes.Unset, server.Status.Code)
+	assert.Equal(t, codes.Error, step.Status.Code)
+}
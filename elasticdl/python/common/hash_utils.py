@@ -23,6 +23,23 @@ def int_to_id(number, bucket_num):
     return number % bucket_num
 
 
+def string_keys(ids):
+    """Returns the string keys in `ids` as a list of str, which TensorFlow
+    gives as bytes, or None if `ids` are integer ids."""
+    if len(ids) == 0 or not isinstance(ids[0], (bytes, str)):
+        return None
+    return [k.decode("utf-8") if isinstance(k, bytes) else k for k in ids]
+
+
+def key_to_id(key, bucket_num):
+    """Hashes an integer id or a string key to a bucket."""
+    if isinstance(key, bytes):
+        key = key.decode("utf-8")
+    if isinstance(key, str):
+        return string_to_id(key, bucket_num)
+    return int_to_id(key, bucket_num)
+
+
 def scatter_embedding_vector(values, indices, bucket_num):
     """
     Scatter embedding vectors to different parameter servers.
@@ -31,7 +48,7 @@ def scatter_embedding_vector(values, indices, bucket_num):
     2. put corresponding item embedding vector to the parameter server id
 
     For example, we scatter following embedding vectors into two parameter
-    servers:
+    servers (string keys are hashed by `string_to_id`):
         values = np.array([[1, 2], [3, 4], [5, 6]])
         indices = np.array([8, 1, 7])
 
@@ -49,7 +66,7 @@ def scatter_embedding_vector(values, indices, bucket_num):
     ps_ids = {}
     indices_list = indices.tolist()
     for i, item_id in enumerate(indices_list):
-        ps_id = int_to_id(item_id, bucket_num)
+        ps_id = key_to_id(item_id, bucket_num)
         if ps_id not in ps_ids:
             ps_ids[ps_id] = [(i, item_id)]
         else:
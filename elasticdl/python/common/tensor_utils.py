@@ -22,6 +22,7 @@ from elasticdl.python.common.dtypes import (
     dtype_numpy_to_tensor,
     dtype_tensor_to_numpy,
 )
+from elasticdl.python.common.hash_utils import string_keys
 
 Tensor = namedtuple("Tensor", ("name", "values", "indices"))
 
@@ -105,7 +106,11 @@ def serialize_indexed_slices(slices, pb):
             "IndexedSlices pb only accepts indices with one dimension, got %d",
             len(slices.indices.shape),
         )
-    pb.ids.extend(slices.indices)
+    keys = string_keys(slices.indices)
+    if keys is not None:
+        pb.keys.extend(keys)
+    else:
+        pb.ids.extend(slices.indices)
 
 
 def indexed_slices_to_pb(slices):
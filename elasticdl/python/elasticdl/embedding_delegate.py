@@ -28,13 +28,16 @@ class EmbeddingDelegate(object):
     The common component to interact the external embedding
     storage such as the parameter server.
     Both ElasticDL Embedding Layer and Embedding Column will
-    use this component.
+    use this component. With `string_keys`, ids are string keys
+    and empty keys are invalid.
     """
 
-    def __init__(self, input_dim, output_dim, name=None):
+    def __init__(self, input_dim, output_dim, name=None, string_keys=False):
         self.input_dim = input_dim
         self.output_dim = output_dim
         self.name = name
+        self.string_keys = string_keys
+        self._ids_dtype = tf.string if string_keys else tf.int64
         self._lookup_embedding_func = None
         self._embedding_and_ids_eagerly = []
         # BET's shape and ids' shape in `self._embedding_and_ids_graph` have
@@ -63,9 +66,11 @@ class EmbeddingDelegate(object):
                     trainable=True,
                 ),
                 batch_ids=tf.Variable(
-                    initial_value=lambda: tf.zeros((1, 1), dtype=tf.int64),
+                    initial_value=lambda: tf.zeros(
+                        (1, 1), dtype=self._ids_dtype
+                    ),
                     shape=tf.TensorShape(None),
-                    dtype=tf.int64,
+                    dtype=self._ids_dtype,
                     trainable=False,
                 ),
             )
@@ -79,7 +84,8 @@ class EmbeddingDelegate(object):
         """
         self._init_for_graph_mode_if_necessary()
 
-        ids = tf.cast(ids, tf.int64)
+        if not self.string_keys:
+            ids = tf.cast(ids, tf.int64)
         ids = tf.convert_to_tensor(ids, name=self.name + "_ids")
         flat_ids = tf.reshape(ids, [-1])
         unique_ids, idx = tf.unique(flat_ids)
@@ -119,7 +125,7 @@ class EmbeddingDelegate(object):
         sparse_ids = _prune_invalid_ids(sparse_ids)
         # Fill in dummy values for empty features, if necessary.
         sparse_ids, is_row_empty = sparse_ops.sparse_fill_empty_rows(
-            sparse_ids, 0
+            sparse_ids, "" if self.string_keys else 0
         )
         unique_ids, idx = tf.unique(sparse_ids.values)
 
@@ -252,7 +258,7 @@ class EmbeddingDelegate(object):
             return embedding_vectors
 
     def _check_id_valid(self, ids):
-        if not self.input_dim:
+        if not self.input_dim or self.string_keys:
             return
 
         first_may_exceed_id = ids[np.argmax(ids >= self.input_dim)]
@@ -304,7 +310,10 @@ class EmbeddingDelegate(object):
 
 
 def _prune_invalid_ids(sparse_ids):
-    """Prune invalid IDs (< 0) from the input ids."""
-    is_id_valid = tf.greater_equal(sparse_ids.values, 0)
+    """Prune invalid IDs (< 0) or empty string keys from the input ids."""
+    if sparse_ids.values.dtype == tf.string:
+        is_id_valid = tf.not_equal(sparse_ids.values, "")
+    else:
+        is_id_valid = tf.greater_equal(sparse_ids.values, 0)
     sparse_ids = sparse_ops.sparse_retain(sparse_ids, is_id_valid)
     return sparse_ids
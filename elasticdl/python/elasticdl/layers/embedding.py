@@ -41,6 +41,10 @@ class Embedding(tf.keras.layers.Layer):
       combiner: A string specifying the reduction op or None if not used.
         "mean", "sqrtn" and "sum" are supported for the reduction op.
         If input is SparseTensor, combiner must set as a reduction op.
+      string_keys: Whether the inputs are string keys, such as raw feature
+        values, instead of integer ids. The parameter server gives each key
+        its own row, so input_dim is not used. Only the Go parameter server
+        supports it.
     """
 
     def __init__(
@@ -51,6 +55,7 @@ class Embedding(tf.keras.layers.Layer):
         mask_zero=False,
         input_length=None,
         combiner=None,
+        string_keys=False,
         **kwargs
     ):
         if "input_shape" not in kwargs and input_length:
@@ -64,6 +69,7 @@ class Embedding(tf.keras.layers.Layer):
         self.supports_masking = mask_zero
         self.input_length = input_length
         self.combiner = combiner
+        self.string_keys = string_keys
         self._embedding_and_ids_eagerly = []
 
         # BET's shape and ids' shape in `self._embedding_and_ids_graph` have
@@ -73,7 +79,10 @@ class Embedding(tf.keras.layers.Layer):
         self._embedding_and_ids_graph = []
         self.embedding_weight_name = self.name + "/embeddings:0"
         self.embedding_delegate = EmbeddingDelegate(
-            self.input_dim, self.output_dim, self.embedding_weight_name
+            self.input_dim,
+            self.output_dim,
+            self.embedding_weight_name,
+            string_keys=string_keys,
         )
 
     @tf_utils.shape_type_conversion
@@ -115,7 +124,8 @@ class Embedding(tf.keras.layers.Layer):
         return "-".join(map(str, name_list))
 
     def call(self, input):
-        input = tf.cast(input, tf.int64)
+        if not self.string_keys:
+            input = tf.cast(input, tf.int64)
         if isinstance(input, tf.SparseTensor):
             return self._sparse_input_call(input)
         else:
@@ -136,7 +146,7 @@ class Embedding(tf.keras.layers.Layer):
             raise ValueError("SparseTensor inputs do not support mask_zero")
         if not self.supports_masking:
             return None
-        return tf.math.not_equal(inputs, 0)
+        return tf.math.not_equal(inputs, "" if self.string_keys else 0)
 
     def reset(self):
         self.embedding_delegate.reset()
@@ -42,7 +42,10 @@ from elasticdl.python.data.reader.data_reader_factory import create_data_reader
 from elasticdl.python.elasticdl.callbacks import MaxStepsStopping
 from elasticdl.python.master.evaluation_service import EvaluationService
 from elasticdl.python.master.k8s_instance_manager import InstanceManager
-from elasticdl.python.master.servicer import MasterServicer
+from elasticdl.python.master.servicer import (
+    PS_HEARTBEAT_INTERVAL_SECS,
+    MasterServicer,
+)
 from elasticdl.python.master.task_dispatcher import _TaskDispatcher
 from elasticdl.python.master.tensorboard_service import TensorboardService
 from elasticdl_client.common.args import (
@@ -172,6 +175,9 @@ class Master(object):
             name="check_timeout_tasks",
             daemon=True,
         ).start()
+        threading.Thread(
+            target=self._check_hung_ps, name="check_hung_ps", daemon=True,
+        ).start()
 
     def _set_completed_steps_by_checkpoint(self, checkpoint_dir_for_init):
         if not checkpoint_dir_for_init:
@@ -431,6 +437,7 @@ class Master(object):
                     + str(args.checkpoint_dir_for_init),
                     "-opt_type=" + opt_type,
                     "-opt_args=" + opt_args,
+                    "-heartbeat_interval=%ds" % PS_HEARTBEAT_INTERVAL_SECS,
                 ]
                 ps_command_args = wrap_go_args_with_string(ps_command_args)
                 # Execute source /root/.bashrc to add the file path
@@ -556,3 +563,16 @@ class Master(object):
                         self.instance_manager._remove_worker(worker_id)
                         break
             time.sleep(30)
+
+    def _check_hung_ps(self):
+        """Relaunch the PS pods which stop sending heartbeats. The relaunched
+        PS keeps its ID and service address, and registers again.
+        """
+        while True:
+            for ps_id in self.master_servicer.pop_hung_ps_ids():
+                self.logger.info(
+                    "PS %d misses heartbeats, relaunch it" % ps_id
+                )
+                if self.instance_manager:
+                    self.instance_manager._remove_ps(ps_id)
+            time.sleep(10)
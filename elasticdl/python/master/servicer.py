@@ -20,6 +20,13 @@ from google.protobuf import empty_pb2
 from elasticdl.proto import elasticdl_pb2, elasticdl_pb2_grpc
 from elasticdl.python.common.log_utils import default_logger as logger
 
+# The interval the master asks Go PS pods to send heartbeats at.
+PS_HEARTBEAT_INTERVAL_SECS = 10
+# A PS is considered hung once it misses this many heartbeats in a row.
+_PS_HEARTBEAT_MISSES_TO_HANG = 3
+# A PS is considered hung once it reports an RPC in flight for this long.
+_PS_RPC_SECS_TO_HANG = 600
+
 
 class MasterServicer(elasticdl_pb2_grpc.MasterServicer):
     """Master service implementation"""
@@ -39,6 +46,8 @@ class MasterServicer(elasticdl_pb2_grpc.MasterServicer):
             elasticdl_pb2.TRAINING: [],
         }
         self._worker_liveness_time = {}
+        # PS id to the last status and the time it was reported.
+        self._ps_status = {}
         if evaluation_service:
             evaluation_service.set_master_servicer(self)
 
@@ -117,6 +126,54 @@ class MasterServicer(elasticdl_pb2_grpc.MasterServicer):
             )
         return empty_pb2.Empty()
 
+    def register_ps(self, request, _):
+        logger.info(
+            "PS %d registered at %s with heartbeats every %d seconds"
+            % (request.ps_id, request.addr, request.heartbeat_interval_secs)
+        )
+        with self._lock:
+            self._ps_status[request.ps_id] = (request, time.time())
+        return empty_pb2.Empty()
+
+    def ps_heartbeat(self, request, _):
+        res = elasticdl_pb2.PsHeartbeatResponse()
+        with self._lock:
+            if request.ps_id in self._ps_status:
+                self._ps_status[request.ps_id] = (request, time.time())
+                res.registered = True
+        return res
+
+    def get_ps_status(self, ps_id):
+        with self._lock:
+            if ps_id not in self._ps_status:
+                return None
+            return self._ps_status[ps_id][0]
+
+    def pop_hung_ps_ids(self, cur_time=None):
+        """Return the ids of the registered PS pods which missed
+        `_PS_HEARTBEAT_MISSES_TO_HANG` heartbeats, or are ready but have an
+        RPC stuck for `_PS_RPC_SECS_TO_HANG` seconds, and forget them until
+        they register again. RPCs wait while the model is restored.
+        """
+        if cur_time is None:
+            cur_time = time.time()
+        hung_ps_ids = []
+        with self._lock:
+            for ps_id, (status, heartbeat_time) in list(
+                self._ps_status.items()
+            ):
+                timeout = _PS_HEARTBEAT_MISSES_TO_HANG * max(
+                    status.heartbeat_interval_secs, 1
+                )
+                if (
+                    cur_time - heartbeat_time > timeout
+                    or status.ready
+                    and status.oldest_rpc_age_secs > _PS_RPC_SECS_TO_HANG
+                ):
+                    hung_ps_ids.append(ps_id)
+                    del self._ps_status[ps_id]
+        return hung_ps_ids
+
     def get_average_task_complete_time(self):
         if len(self._task_complete_times) < 20:
             return {
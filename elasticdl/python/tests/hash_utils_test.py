@@ -18,6 +18,8 @@ import numpy as np
 from elasticdl.python.common.hash_utils import (
     int_to_id,
     scatter_embedding_vector,
+    string_keys,
+    string_to_id,
 )
 
 
@@ -53,6 +55,26 @@ class HashUtilTest(unittest.TestCase):
             )
             self.assertListEqual(results[ps_id][1], expected_results[ps_id][1])
 
+    def test_scatter_string_keys(self):
+        vectors = np.array([[1, 2], [3, 4], [5, 6]])
+        keys = np.array([b"a", b"b", b"c"], dtype=object)
+        num = 2
+
+        results = scatter_embedding_vector(vectors, keys, num)
+        for ps_id, (values, ps_keys) in results.items():
+            for value, key in zip(values, ps_keys):
+                key_ps_id = string_to_id(key.decode("utf-8"), num)
+                self.assertEqual(key_ps_id, ps_id)
+                i = keys.tolist().index(key)
+                np.testing.assert_array_equal(value, vectors[i])
+
+    def test_string_keys(self):
+        self.assertListEqual(
+            string_keys(np.array([b"a", b"b"], dtype=object)), ["a", "b"]
+        )
+        self.assertIsNone(string_keys(np.array([1, 2])))
+        self.assertIsNone(string_keys(np.array([], dtype=object)))
+
 
 if __name__ == "__main__":
     unittest.main()
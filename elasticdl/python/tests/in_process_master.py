@@ -44,3 +44,9 @@ class InProcessMaster(object):
 
     def report_version(self, req):
         return self._m.report_version(req, None)
+
+    def register_ps(self, req):
+        return self._m.register_ps(req, None)
+
+    def ps_heartbeat(self, req):
+        return self._m.ps_heartbeat(req, None)
@@ -111,6 +111,48 @@ class ServicerTest(unittest.TestCase):
             tasks,
         )
 
+    def testPsHeartbeat(self):
+        master = MasterServicer(
+            3,
+            _TaskDispatcher({}, {}, {}, records_per_task=3, num_epochs=2),
+            evaluation_service=None,
+        )
+        status = elasticdl_pb2.PsStatus()
+        status.ps_id = 1
+        status.addr = "localhost:2222"
+        status.heartbeat_interval_secs = 10
+
+        # The master asks an unknown PS to register.
+        self.assertFalse(master.ps_heartbeat(status, None).registered)
+        self.assertIsNone(master.get_ps_status(1))
+
+        master.register_ps(status, None)
+        status.model_version = 5
+        status.ready = True
+        status.embedding_table_rows["e1"] = 100
+        self.assertTrue(master.ps_heartbeat(status, None).registered)
+        ps_status = master.get_ps_status(1)
+        self.assertEqual(5, ps_status.model_version)
+        self.assertTrue(ps_status.ready)
+        self.assertEqual(100, ps_status.embedding_table_rows["e1"])
+
+        # A PS is hung after missing 3 heartbeats, and forgotten.
+        heartbeat_time = master._ps_status[1][1]
+        self.assertEqual([], master.pop_hung_ps_ids(heartbeat_time + 30))
+        self.assertEqual([1], master.pop_hung_ps_ids(heartbeat_time + 31))
+        self.assertIsNone(master.get_ps_status(1))
+        self.assertEqual([], master.pop_hung_ps_ids(heartbeat_time + 60))
+        self.assertFalse(master.ps_heartbeat(status, None).registered)
+
+        # A PS with an RPC stuck for 10 minutes is hung despite heartbeats.
+        master.register_ps(status, None)
+        status.oldest_rpc_age_secs = 600
+        master.ps_heartbeat(status, None)
+        self.assertEqual([], master.pop_hung_ps_ids())
+        status.oldest_rpc_age_secs = 601
+        master.ps_heartbeat(status, None)
+        self.assertEqual([1], master.pop_hung_ps_ids())
+
 
 if __name__ == "__main__":
     unittest.main()
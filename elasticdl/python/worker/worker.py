@@ -29,8 +29,9 @@ from elasticdl.python.common.constants import (
 )
 from elasticdl.python.common.dtypes import dtype_numpy_to_tensor
 from elasticdl.python.common.hash_utils import (
-    int_to_id,
+    key_to_id,
     scatter_embedding_vector,
+    string_keys,
     string_to_id,
 )
 from elasticdl.python.common.log_utils import get_logger
@@ -378,11 +379,15 @@ class Worker(object):
         self._timing.end_record_time("get_model")
 
     def pull_embedding_vectors(self, layer_name, embedding_ids):
-        """Pulls and returns embedding vectors ordered by the embedding ids."""
+        """Pulls and returns embedding vectors ordered by the embedding ids.
+        The ids of a table with string keys are its keys."""
+        keys = string_keys(embedding_ids)
+        if keys is not None:
+            embedding_ids = keys
         ps_ids = {}
         ps_ids_index = {}
         for idx, embedding_id in enumerate(embedding_ids):
-            ps_id = int_to_id(embedding_id, self._ps_num)
+            ps_id = key_to_id(embedding_id, self._ps_num)
             ps_ids.setdefault(ps_id, []).append(embedding_id)
             ps_ids_index.setdefault(ps_id, []).append(idx)
 
@@ -390,9 +395,12 @@ class Worker(object):
         index = []
         pb_future_and_id_pairs = []
         for ps_id, embedding_ids in ps_ids.items():
-            req = elasticdl_pb2.PullEmbeddingVectorRequest()
+            req = elasticdl_pb2.PullEmbeddingVectorsRequest()
             req.name = layer_name
-            req.ids.extend(embedding_ids)
+            if keys is not None:
+                req.keys.extend(embedding_ids)
+            else:
+                req.ids.extend(embedding_ids)
             pb_future = self._ps_stubs[ps_id].pull_embedding_vectors.future(
                 req
             )
@@ -440,6 +448,8 @@ class Worker(object):
                 embedding_info.name = layer.embedding_weight_name
                 embedding_info.dim = layer.output_dim
                 embedding_info.initializer = layer.embeddings_initializer
+                if layer.string_keys:
+                    embedding_info.key_type = elasticdl_pb2.STRING_KEY
                 # set to float32
                 embedding_info.dtype = dtype_numpy_to_tensor(
                     np.dtype("float32")
@@ -34,6 +34,14 @@ make -f elasticdl/Makefile
     go mod edit -replace \
         github.com/tensorflow="${GOPATH}"/pkg/mod/github.com/tensorflow
     go get -u -t k8s.io/client-go@v0.17.0
+    # The OpenTelemetry releases supported by the Go in the image, with the
+    # genproto module which no longer contains googleapis/rpc.
+    go get go.opentelemetry.io/otel@v1.34.0 \
+        go.opentelemetry.io/otel/sdk@v1.34.0 \
+        go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc@v1.34.0 \
+        go.opentelemetry.io/otel/exporters/stdout/stdouttrace@v1.34.0 \
+        google.golang.org/genproto@v0.0.0-20250603155806-513f23925822 \
+        github.com/prometheus/client_golang@v1.20.5
     go mod tidy
     GOBIN=/tmp go install ./...
 )
@@ -47,5 +55,6 @@ python setup_client.py --quiet bdist_wheel --dist-dir ./build
 # Create elasticdl package
 mkdir -p ./elasticdl/go/bin
 cp /tmp/elasticdl_ps ./elasticdl/go/bin/
+cp /tmp/elasticdl_ps_stats ./elasticdl/go/bin/
 rm -rf ./build/lib
 python setup.py --quiet bdist_wheel --dist-dir ./build
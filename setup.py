@@ -50,6 +50,7 @@ setup(
             "Makefile",
             "requirements.txt",
             "go/bin/elasticdl_ps",
+            "go/bin/elasticdl_ps_stats",
             "go/pkg/kernel/capi/*",
         ]
     },